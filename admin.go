@@ -0,0 +1,263 @@
+package storagefirestore
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI serves lock introspection on Caddy's admin endpoint.
+//
+//	GET  /firestore/locks[?prefix=<prefix>]  lists the locks
+//	GET  /firestore/locks?key=<key>          describes one lock
+//	POST /firestore/locks/unlock             force unlocks a lock
+//	GET  /firestore/breaker                  describes the circuit breakers
+//
+// Force unlocks take a forceUnlockRequest and must be authenticated with
+// "Authorization: Bearer <admin_token>".
+//
+// Admin modules are not provisioned, so it serves whichever Storage
+// instances are currently provisioned.
+type AdminAPI struct{}
+
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.firestore",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/firestore/locks", Handler: caddy.AdminHandlerFunc(a.handleLocks)},
+		{Pattern: "/firestore/locks/unlock", Handler: caddy.AdminHandlerFunc(a.handleForceUnlock)},
+		{Pattern: "/firestore/breaker", Handler: caddy.AdminHandlerFunc(a.handleBreaker)},
+	}
+}
+
+// forceUnlockRequest is the body of POST /firestore/locks/unlock.
+type forceUnlockRequest struct {
+	Key    string `json:"key"`
+	By     string `json:"by"`
+	Reason string `json:"reason"`
+	Force  bool   `json:"force"`
+}
+
+func (a *AdminAPI) handleLocks(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			Code: http.StatusMethodNotAllowed,
+			Err:  fmt.Errorf("method not allowed"),
+		}
+	}
+
+	active := activeStorages()
+	if len(active) == 0 {
+		return caddy.APIError{
+			Code: http.StatusNotFound,
+			Err:  fmt.Errorf("no firestore storage is provisioned"),
+		}
+	}
+
+	if key := r.URL.Query().Get("key"); key != "" {
+		for _, s := range active {
+			info, err := s.LockInfo(key)
+			if err == nil {
+				return writeJSON(w, info)
+			}
+			if !errors.Is(err, ErrLockNotFound) {
+				return caddy.APIError{Code: http.StatusInternalServerError, Err: err}
+			}
+		}
+		return caddy.APIError{
+			Code: http.StatusNotFound,
+			Err:  fmt.Errorf("lock %s not found", key),
+		}
+	}
+
+	infos := []*LockInfo{}
+	for _, s := range active {
+		found, err := s.ListLocks(r.URL.Query().Get("prefix"))
+		if err != nil {
+			return caddy.APIError{Code: http.StatusInternalServerError, Err: err}
+		}
+		infos = append(infos, found...)
+	}
+	return writeJSON(w, infos)
+}
+
+func (a *AdminAPI) handleForceUnlock(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			Code: http.StatusMethodNotAllowed,
+			Err:  fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var req forceUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			Code: http.StatusBadRequest,
+			Err:  fmt.Errorf("decoding request: %v", err),
+		}
+	}
+	if req.Key == "" || req.Reason == "" {
+		return caddy.APIError{
+			Code: http.StatusBadRequest,
+			Err:  fmt.Errorf("key and reason are required"),
+		}
+	}
+
+	active, err := authorizedStorages(r)
+	if err != nil {
+		return err
+	}
+
+	by := req.By
+	if by == "" {
+		by = "unknown"
+	}
+	by = fmt.Sprintf("%s via %s", by, r.RemoteAddr)
+
+	for _, s := range active {
+		info, err := s.ForceUnlock(req.Key, by, req.Reason, req.Force)
+		switch {
+		case err == nil:
+			return writeJSON(w, info)
+		case errors.Is(err, ErrLockNotFound):
+			continue
+		case errors.Is(err, ErrLockTooYoung):
+			return caddy.APIError{Code: http.StatusConflict, Err: err}
+		default:
+			return caddy.APIError{Code: http.StatusInternalServerError, Err: err}
+		}
+	}
+
+	return caddy.APIError{
+		Code: http.StatusNotFound,
+		Err:  fmt.Errorf("lock %s not found", req.Key),
+	}
+}
+
+// breakerInfo describes the circuit breaker of a Storage instance.
+type breakerInfo struct {
+	Project    string `json:"project"`
+	Collection string `json:"collection"`
+	BreakerStatus
+}
+
+func (a *AdminAPI) handleBreaker(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			Code: http.StatusMethodNotAllowed,
+			Err:  fmt.Errorf("method not allowed"),
+		}
+	}
+
+	// Each instance has its own breaker, so list them all rather than one
+	// per lock collection.
+	storages.m.Lock()
+	all := append([]*Storage(nil), storages.active...)
+	storages.m.Unlock()
+
+	infos := []breakerInfo{}
+	for _, s := range all {
+		if status, ok := s.Breaker(); ok {
+			infos = append(infos, breakerInfo{s.ProjectId, s.Collection, status})
+		}
+	}
+	return writeJSON(w, infos)
+}
+
+// authorizedStorages returns the active storages whose admin_token the
+// request carries.
+func authorizedStorages(r *http.Request) ([]*Storage, error) {
+	var configured bool
+	var authorized []*Storage
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, s := range activeStorages() {
+		if s.AdminToken == "" {
+			continue
+		}
+		configured = true
+		if subtle.ConstantTimeCompare([]byte(s.AdminToken), []byte(token)) == 1 {
+			authorized = append(authorized, s)
+		}
+	}
+
+	if !configured {
+		return nil, caddy.APIError{
+			Code: http.StatusForbidden,
+			Err:  fmt.Errorf("force unlock is disabled; set admin_token to enable it"),
+		}
+	}
+	if len(authorized) == 0 {
+		return nil, caddy.APIError{
+			Code: http.StatusUnauthorized,
+			Err:  fmt.Errorf("invalid admin token"),
+		}
+	}
+	return authorized, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// The provisioned Storage instances.
+var storages struct {
+	active []*Storage
+	m      sync.Mutex
+}
+
+func registerStorage(s *Storage) {
+	storages.m.Lock()
+	defer storages.m.Unlock()
+	storages.active = append(storages.active, s)
+}
+
+func unregisterStorage(s *Storage) {
+	storages.m.Lock()
+	defer storages.m.Unlock()
+	for i, other := range storages.active {
+		if other == s {
+			storages.active = append(storages.active[:i], storages.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// activeStorages returns the provisioned Storage instances, one for each
+// lock collection.
+func activeStorages() []*Storage {
+	storages.m.Lock()
+	defer storages.m.Unlock()
+
+	type collection struct{ project, name string }
+	seen := map[collection]bool{}
+	var active []*Storage
+	for _, s := range storages.active {
+		c := collection{s.ProjectId, s.LockCollection}
+		if !seen[c] {
+			seen[c] = true
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
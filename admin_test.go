@@ -0,0 +1,111 @@
+package storagefirestore
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI_handleLocks(t *testing.T) {
+	a := &AdminAPI{}
+	assert.Len(t, a.Routes(), 3)
+
+	// Only GET.
+	err := a.handleLocks(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/firestore/locks", nil))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, err.(caddy.APIError).Code)
+
+	// Nothing provisioned.
+	err = a.handleLocks(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/firestore/locks", nil))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, err.(caddy.APIError).Code)
+}
+
+func TestStorage_registerStorage(t *testing.T) {
+	s1 := New()
+	s1.ProjectId = "p"
+	s2 := New()
+	s2.ProjectId = "p"
+	s3 := New()
+	s3.ProjectId = "p"
+	s3.LockCollection = "other"
+
+	registerStorage(s1)
+	registerStorage(s2)
+	registerStorage(s3)
+
+	// One per lock collection.
+	assert.Equal(t, []*Storage{s1, s3}, activeStorages())
+
+	unregisterStorage(s1)
+	assert.Equal(t, []*Storage{s2, s3}, activeStorages())
+
+	unregisterStorage(s2)
+	unregisterStorage(s3)
+	assert.Empty(t, activeStorages())
+}
+
+func TestAdminAPI_handleForceUnlock(t *testing.T) {
+	a := &AdminAPI{}
+	unlock := func(token, body string) error {
+		r := httptest.NewRequest(http.MethodPost, "/firestore/locks/unlock", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return a.handleForceUnlock(httptest.NewRecorder(), r)
+	}
+	code := func(err error) int {
+		return err.(caddy.APIError).Code
+	}
+
+	err := a.handleForceUnlock(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/firestore/locks/unlock", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, code(err))
+
+	assert.Equal(t, http.StatusBadRequest, code(unlock("", "{")))
+	assert.Equal(t, http.StatusBadRequest, code(unlock("", `{"key": "k"}`)))
+
+	// Disabled unless a storage has an admin token.
+	s := New()
+	registerStorage(s)
+	defer unregisterStorage(s)
+	assert.Equal(t, http.StatusForbidden, code(unlock("secret", `{"key": "k", "reason": "r"}`)))
+
+	s.AdminToken = "secret"
+	assert.Equal(t, http.StatusUnauthorized, code(unlock("", `{"key": "k", "reason": "r"}`)))
+	assert.Equal(t, http.StatusUnauthorized, code(unlock("wrong", `{"key": "k", "reason": "r"}`)))
+}
+
+func TestAdminAPI_handleBreaker(t *testing.T) {
+	a := &AdminAPI{}
+
+	err := a.handleBreaker(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/firestore/breaker", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, err.(caddy.APIError).Code)
+
+	s1 := New()
+	s1.ProjectId = "p"
+	s1.breaker = newCircuitBreaker(1, time.Minute, nil)
+	s2 := New()
+	s2.ProjectId = "p"
+	registerStorage(s1)
+	registerStorage(s2)
+	defer unregisterStorage(s1)
+	defer unregisterStorage(s2)
+
+	s1.breaker.guard(func() error { return status.Error(codes.Unavailable, "down") })
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, a.handleBreaker(w, httptest.NewRequest(http.MethodGet, "/firestore/breaker", nil)))
+	var infos []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "p", infos[0]["project"])
+	assert.Equal(t, "open", infos[0]["state"])
+	assert.Equal(t, 1.0, infos[0]["failures"])
+}
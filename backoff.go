@@ -0,0 +1,118 @@
+package storagefirestore
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Strategies for spacing out attempts at a contended lock when the lock
+// listener isn't available. The delays are bounded by MinPollSeconds and
+// MaxPollSeconds, which may be fractional.
+//
+// The exponential strategies adapt to contention: they keep growing while
+// the same holder keeps the lock, as for a long critical section, and
+// start over once it changes hands, since it is then turning over quickly.
+const (
+	// BackoffUniform waits a uniformly random time between the bounds on
+	// every attempt.
+	BackoffUniform = "uniform"
+
+	// BackoffExponential doubles the ceiling on every attempt, starting
+	// from MinPollSeconds and capped at MaxPollSeconds, and waits a random
+	// time below it ("full jitter").
+	BackoffExponential = "exponential"
+
+	// BackoffDecorrelated waits a random time between MinPollSeconds and
+	// three times the previous delay, capped at MaxPollSeconds
+	// ("decorrelated jitter").
+	BackoffDecorrelated = "decorrelated"
+)
+
+// minBackoffBase keeps exponential strategies from spinning when
+// MinPollSeconds is 0.
+const minBackoffBase = 50 * time.Millisecond
+
+// lockBackoff computes the delays between the attempts of one acquisition.
+type lockBackoff struct {
+	strategy string
+	min, max time.Duration
+	attempt  int
+	prev     time.Duration
+
+	// The holder seen on the last attempt.
+	holder string
+}
+
+func (s *Storage) newBackoff() *lockBackoff {
+	return &lockBackoff{
+		strategy: s.LockBackoff,
+		min:      seconds(s.MinPollSeconds),
+		max:      seconds(s.MaxPollSeconds),
+	}
+}
+
+// next returns the delay before the next attempt.
+func (b *lockBackoff) next() time.Duration {
+	b.attempt++
+
+	base := b.min
+	if base < minBackoffBase {
+		base = minBackoffBase
+	}
+
+	var d time.Duration
+	switch b.strategy {
+	case BackoffExponential:
+		ceiling := b.max
+		if b.attempt < 32 && base<<(b.attempt-1) < b.max {
+			ceiling = base << (b.attempt - 1)
+		}
+		d = randBetween(0, ceiling)
+	case BackoffDecorrelated:
+		prev := b.prev
+		if prev < base {
+			prev = base
+		}
+		d = randBetween(base, 3*prev)
+	default:
+		d = randBetween(b.min, b.max)
+	}
+
+	if d > b.max {
+		d = b.max
+	}
+	b.prev = d
+	return d
+}
+
+// observe records the holder seen on a failed attempt. A new holder
+// restarts the growth of the delays.
+func (b *lockBackoff) observe(holder string) {
+	if b.holder != "" && holder != b.holder {
+		b.attempt = 0
+		b.prev = 0
+	}
+	b.holder = holder
+}
+
+// validBackoff reports an error for unknown strategy names.
+func validBackoff(strategy string) error {
+	switch strategy {
+	case "", BackoffUniform, BackoffExponential, BackoffDecorrelated:
+		return nil
+	}
+	return fmt.Errorf("unknown lock backoff strategy %q", strategy)
+}
+
+// randBetween returns a uniformly random duration in [min, max).
+func randBetween(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
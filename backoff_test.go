@@ -0,0 +1,109 @@
+package storagefirestore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLockBackoff_uniform(t *testing.T) {
+	s := Storage{
+		MinPollSeconds: 10,
+		MaxPollSeconds: 20,
+	}
+	b := s.newBackoff()
+
+	min := 10 * time.Second
+	max := 20 * time.Second
+
+	n := 100
+	samples := map[time.Duration]bool{}
+	for i := 0; i < n; i++ {
+		x := b.next()
+		assert.Less(t, float64(x), float64(max))
+		assert.GreaterOrEqual(t, float64(x), float64(min))
+		samples[x] = true
+	}
+
+	assert.Len(t, samples, n)
+}
+
+func TestLockBackoff_exponential(t *testing.T) {
+	s := Storage{
+		MinPollSeconds: 0.1,
+		MaxPollSeconds: 2,
+		LockBackoff:    BackoffExponential,
+	}
+	b := s.newBackoff()
+
+	// The ceiling doubles from the minimum up to the cap.
+	ceiling := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		x := b.next()
+		assert.GreaterOrEqual(t, float64(x), float64(0))
+		assert.LessOrEqual(t, float64(x), float64(ceiling))
+		if ceiling < 2*time.Second {
+			ceiling *= 2
+		}
+		if ceiling > 2*time.Second {
+			ceiling = 2 * time.Second
+		}
+	}
+}
+
+func TestLockBackoff_decorrelated(t *testing.T) {
+	s := Storage{
+		MinPollSeconds: 0.1,
+		MaxPollSeconds: 2,
+		LockBackoff:    BackoffDecorrelated,
+	}
+	b := s.newBackoff()
+
+	prev := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		x := b.next()
+		assert.GreaterOrEqual(t, float64(x), float64(100*time.Millisecond))
+		assert.LessOrEqual(t, float64(x), float64(2*time.Second))
+		assert.LessOrEqual(t, float64(x), float64(3*prev))
+		prev = x
+	}
+}
+
+func TestLockBackoff_zeroMin(t *testing.T) {
+	// Decorrelated backoff doesn't spin without a minimum.
+	s := Storage{MaxPollSeconds: 1, LockBackoff: BackoffDecorrelated}
+	b := s.newBackoff()
+	for i := 0; i < 10; i++ {
+		assert.GreaterOrEqual(t, float64(b.next()), float64(minBackoffBase))
+	}
+}
+
+func TestLockBackoff_observe(t *testing.T) {
+	s := Storage{
+		MinPollSeconds: 0.1,
+		MaxPollSeconds: 100,
+		LockBackoff:    BackoffExponential,
+	}
+	b := s.newBackoff()
+
+	// The same holder keeps the delays growing.
+	b.observe("a")
+	for i := 0; i < 5; i++ {
+		b.next()
+		b.observe("a")
+	}
+	assert.Equal(t, 5, b.attempt)
+
+	// A new one starts them over.
+	b.observe("b")
+	assert.Equal(t, 0, b.attempt)
+	assert.LessOrEqual(t, float64(b.next()), float64(100*time.Millisecond))
+}
+
+func TestValidBackoff(t *testing.T) {
+	assert.NoError(t, validBackoff(""))
+	assert.NoError(t, validBackoff(BackoffUniform))
+	assert.NoError(t, validBackoff(BackoffExponential))
+	assert.NoError(t, validBackoff(BackoffDecorrelated))
+	assert.Error(t, validBackoff("linear"))
+}
@@ -0,0 +1,360 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/caddyserver/certmagic"
+	"sort"
+	"time"
+)
+
+// Batch operations, for tools working on many keys at once.
+//
+// Keys are read with GetAll and written with batched writes, up to
+// maxBatchOps at a time. Each batch of writes only applies if none of its
+// records changed since they were read; if it fails for another reason
+// than Firestore being unavailable, its keys are retried one by one so
+// that each gets its own error. Keys whose lock this instance holds are
+// always written one by one, to be fenced like Store and Delete.
+
+// Firestore commits at most 500 writes at once.
+const maxBatchOps = 500
+
+// KeyErrors is returned by the batch operations when some of their keys
+// failed, with why. The other keys succeeded.
+type KeyErrors map[string]error
+
+func (e KeyErrors) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 1 {
+		return fmt.Sprintf("%s: %v", keys[0], e[keys[0]])
+	}
+	return fmt.Sprintf("%d keys failed, first %s: %v", len(keys), keys[0], e[keys[0]])
+}
+
+// err returns e if a key failed, and nil otherwise.
+func (e KeyErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// LoadMany loads keys. Keys that fail to load, including missing ones
+// (certmagic.ErrNotExist), are left out of the result and reported in a
+// KeyErrors.
+func (s *Storage) LoadMany(keys []string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	errs := KeyErrors{}
+
+	var remote []string
+	for _, key := range keys {
+		if cert, found, err := s.queuedRecord(key); err != nil {
+			errs[key] = err
+		} else if found {
+			values[key] = cert.Raw
+		} else if cert, found := s.cache.get(key); found {
+			values[key] = cert.Raw
+		} else {
+			remote = append(remote, key)
+		}
+	}
+
+	for start := 0; start < len(remote); start += maxBatchOps {
+		batch := remote[start:batchEnd(start, len(remote))]
+		gen := s.cache.generation()
+
+		docs, err := s.getAll(context.Background(), batch)
+		for i, key := range batch {
+			var cert *Record
+			var keyErr error
+			switch {
+			case err != nil:
+				cert, keyErr = s.fallbackRecord(key, err)
+			case !docs[i].Exists():
+				keyErr = certmagic.ErrNotExist(fmt.Errorf("key %s not found", key))
+			default:
+				cert, keyErr = s.decryptDoc(key, docs[i])
+				if keyErr == nil {
+					s.cache.put(key, cert, gen)
+				}
+			}
+
+			if keyErr != nil {
+				errs[key] = keyErr
+				continue
+			}
+			values[key] = cert.Raw
+		}
+	}
+
+	return values, errs.err()
+}
+
+// StoreMany stores values. Like Store, writes failing because Firestore is
+// unavailable are queued if a write queue is configured. Keys that fail
+// are reported in a KeyErrors.
+func (s *Storage) StoreMany(values map[string][]byte) error {
+	errs := KeyErrors{}
+
+	var writes []*queuedWrite
+	for _, key := range sortedKeys(values) {
+		ciphertext, err := s.encrypt(values[key])
+		if err != nil {
+			errs[key] = err
+			continue
+		}
+
+		lockName, fence := s.heldFence(key)
+		w := &queuedWrite{
+			Key:       key,
+			Raw:       ciphertext,
+			Size:      int64(len(values[key])),
+			Fence:     fence,
+			FenceLock: lockName,
+			QueuedAt:  UTCNow(),
+		}
+		if w.Fence != 0 {
+			if err := s.write(w); err != nil {
+				errs[key] = err
+			}
+			continue
+		}
+		writes = append(writes, w)
+	}
+
+	for start := 0; start < len(writes); start += maxBatchOps {
+		batch := writes[start:batchEnd(start, len(writes))]
+
+		keys := make([]string, len(batch))
+		for i, w := range batch {
+			keys[i] = w.Key
+		}
+		docs, err := s.getAll(context.Background(), keys)
+		if err == nil {
+			err = s.storeBatch(context.Background(), batch, docs)
+		}
+		s.settleStores(batch, err, errs)
+	}
+
+	return errs.err()
+}
+
+// settleStores finishes writing writes after storing them in one batch
+// failed with err, if it did: they are queued if Firestore is unavailable,
+// and written one by one otherwise. Keys that fail are added to errs.
+func (s *Storage) settleStores(writes []*queuedWrite, err error, errs KeyErrors) {
+	for _, w := range writes {
+		s.cache.invalidate(w.Key)
+	}
+	if err == nil {
+		if s.queue != nil {
+			for _, w := range writes {
+				s.queue.discard(w.Key)
+			}
+		}
+		return
+	}
+
+	for _, w := range writes {
+		keyErr := err
+		if !isUnavailable(err) {
+			keyErr = s.write(w)
+		} else if s.queue != nil {
+			keyErr = s.enqueueWrite(w, err)
+		}
+		if keyErr != nil {
+			errs[w.Key] = keyErr
+		}
+	}
+}
+
+// storeBatch writes writes in one batch over docs, their records as read
+// before. It fails if any of them changed since.
+func (s *Storage) storeBatch(ctx context.Context, writes []*queuedWrite, docs []*firestore.DocumentSnapshot) error {
+	now := UTCNow()
+	stored := make([]*Record, len(writes))
+	batch := s.client.Batch()
+	for i, w := range writes {
+		stored[i] = &Record{
+			Raw:       w.Raw,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Size:      w.Size,
+		}
+
+		if !docs[i].Exists() {
+			batch.Create(docs[i].Ref, stored[i])
+			continue
+		}
+
+		var cert Record
+		if err := docs[i].DataTo(&cert); err != nil {
+			return err
+		}
+		// As in storeEncrypted. Writes with a fence are written one by
+		// one, to check their lock's counter too, so this only guards
+		// against callers handing them over anyway.
+		if w.Fence != 0 && cert.Fence > w.Fence {
+			return ErrStaleFence
+		}
+		stored[i].CreatedAt = cert.CreatedAt
+		stored[i].Fence = cert.Fence
+		batch.Update(docs[i].Ref, []firestore.Update{
+			{Path: "updatedAt", Value: now},
+			{Path: "raw", Value: w.Raw},
+			{Path: "size", Value: w.Size},
+		}, firestore.LastUpdateTime(docs[i].UpdateTime))
+	}
+
+	var results []*firestore.WriteResult
+	err := s.breaker.guard(func() (err error) {
+		results, err = batch.Commit(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, w := range writes {
+		s.mirror(w.Key, stored[i])
+		s.sawVersion(w.Key, results[i].UpdateTime)
+	}
+	return nil
+}
+
+// DeleteMany deletes keys. Keys that fail to be deleted, including missing
+// ones (certmagic.ErrNotExist), are reported in a KeyErrors.
+//
+// Like Delete, deletes failing because Firestore is unavailable are not
+// queued: their records, mirrored copies and queued writes are left as
+// they are, and still served, until the keys are deleted again.
+func (s *Storage) DeleteMany(keys []string) error {
+	errs := KeyErrors{}
+
+	var remote []string
+	for _, key := range keys {
+		if _, fence := s.heldFence(key); fence != 0 {
+			if err := s.Delete(key); err != nil {
+				errs[key] = err
+			}
+			continue
+		}
+		remote = append(remote, key)
+	}
+
+	for start := 0; start < len(remote); start += maxBatchOps {
+		batch := remote[start:batchEnd(start, len(remote))]
+
+		deleted, err := s.deleteBatch(context.Background(), batch, errs)
+		for _, key := range batch {
+			s.cache.invalidate(key)
+		}
+		if err == nil {
+			for _, key := range deleted {
+				s.unmirror(key)
+				s.sawVersion(key, time.Time{})
+				if s.queue != nil {
+					s.queue.discard(key)
+				}
+			}
+			continue
+		}
+
+		// Unavailable: nothing was deleted, so nothing is unmirrored.
+		for _, key := range deleted {
+			keyErr := err
+			if !isUnavailable(err) {
+				keyErr = s.Delete(key)
+			}
+			if keyErr != nil {
+				errs[key] = keyErr
+			}
+		}
+	}
+
+	return errs.err()
+}
+
+// deleteBatch deletes the existing records of keys in one batch, which
+// fails if any of them changed since they were read, and returns their
+// keys. Keys only in the write queue have their queued writes dropped;
+// other missing keys are reported in errs.
+func (s *Storage) deleteBatch(ctx context.Context, keys []string, errs KeyErrors) ([]string, error) {
+	docs, err := s.getAll(ctx, keys)
+	if err != nil {
+		return keys, err
+	}
+
+	var deleted []string
+	batch := s.client.Batch()
+	for i, key := range keys {
+		var cert Record
+		if docs[i].Exists() {
+			if err := docs[i].DataTo(&cert); err != nil {
+				errs[key] = err
+				continue
+			}
+		}
+		if !cert.hasValue() {
+			// Missing, or only a lock placeholder.
+			if s.queue != nil && s.queue.latest(key) != nil {
+				// Only stored in the write queue so far.
+				s.queue.discard(key)
+				continue
+			}
+			errs[key] = certmagic.ErrNotExist(fmt.Errorf("key %s not found", key))
+			continue
+		}
+
+		batch.Delete(docs[i].Ref, firestore.LastUpdateTime(docs[i].UpdateTime))
+		deleted = append(deleted, key)
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+
+	err = s.breaker.guard(func() error {
+		_, err := batch.Commit(ctx)
+		return err
+	})
+	return deleted, err
+}
+
+// getAll reads the records of keys, in order, through the circuit breaker.
+func (s *Storage) getAll(ctx context.Context, keys []string) ([]*firestore.DocumentSnapshot, error) {
+	refs := make([]*firestore.DocumentRef, len(keys))
+	for i, key := range keys {
+		refs[i] = s.keyToRef(key)
+	}
+
+	var docs []*firestore.DocumentSnapshot
+	err := s.breaker.guard(func() (err error) {
+		docs, err = s.client.GetAll(ctx, refs)
+		return err
+	})
+	return docs, err
+}
+
+// batchEnd returns the end of the batch starting at start, out of n.
+func batchEnd(start, n int) int {
+	if start+maxBatchOps < n {
+		return start + maxBatchOps
+	}
+	return n
+}
+
+func sortedKeys(values map[string][]byte) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,71 @@
+package storagefirestore
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestKeyErrors(t *testing.T) {
+	errs := KeyErrors{}
+	assert.NoError(t, errs.err())
+
+	errs["b"] = errors.New("boom")
+	assert.Equal(t, "b: boom", errs.err().Error())
+
+	errs["a"] = errors.New("bang")
+	assert.Equal(t, "2 keys failed, first a: bang", errs.err().Error())
+
+	var keyErrs KeyErrors
+	assert.True(t, errors.As(errs.err(), &keyErrs))
+	assert.Len(t, keyErrs, 2)
+}
+
+func TestBatchEnd(t *testing.T) {
+	assert.Equal(t, 3, batchEnd(0, 3))
+	assert.Equal(t, maxBatchOps, batchEnd(0, maxBatchOps+1))
+	assert.Equal(t, maxBatchOps+1, batchEnd(maxBatchOps, maxBatchOps+1))
+}
+
+func TestStorage_batchEmpty(t *testing.T) {
+	// Nothing to do, so no client is needed.
+	s := New()
+	values, err := s.LoadMany(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+	assert.NoError(t, s.StoreMany(nil))
+	assert.NoError(t, s.DeleteMany(nil))
+}
+
+func TestStorage_settleStores(t *testing.T) {
+	s, cleanup := newQueueStorage(t)
+	defer cleanup()
+
+	down := status.Error(codes.Unavailable, "down")
+	writes := []*queuedWrite{{Key: "a", Raw: []byte("x")}, {Key: "b", Raw: []byte("y")}}
+
+	// Queued when Firestore is unavailable.
+	errs := KeyErrors{}
+	s.settleStores(writes, down, errs)
+	assert.Empty(t, errs)
+	assert.NotNil(t, s.queue.latest("a"))
+	assert.NotNil(t, s.queue.latest("b"))
+
+	// Reported without a queue.
+	q := s.queue
+	s.queue = nil
+	s.settleStores(writes, down, errs)
+	assert.Equal(t, KeyErrors{"a": down, "b": down}, errs)
+
+	// Nothing to do after a successful batch, but to drop the older
+	// queued writes.
+	s.queue = q
+	assert.NotNil(t, s.queue.latest("a"))
+	errs = KeyErrors{}
+	s.settleStores(writes, nil, errs)
+	assert.Empty(t, errs)
+	assert.Nil(t, s.queue.latest("a"))
+	assert.Nil(t, s.queue.latest("b"))
+}
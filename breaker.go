@@ -0,0 +1,207 @@
+package storagefirestore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// A circuit breaker around the Firestore calls of Store, Load, Stat,
+// Exists, Delete and List.
+//
+// After breaker_failures consecutive calls fail because Firestore is
+// unavailable, the breaker opens: calls fail right away with
+// ErrCircuitOpen, which reads fall back from to the record cache and the
+// local mirror, and stores to the write queue, as if Firestore had failed.
+// After breaker_cooldown_seconds, a single call is let through to probe
+// Firestore. The breaker closes if it succeeds, and opens again otherwise.
+//
+// Locking calls aren't guarded: they have their own retries and staleness.
+// Only the lock introspection of LockInfo and ListLocks is.
+
+// ErrCircuitOpen is returned instead of calling Firestore while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("firestore circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+func (state BreakerState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// Called with every state change.
+	changed func(from, to BreakerState)
+
+	m        sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// BreakerStatus describes a circuit breaker.
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+
+	// Consecutive failures so far.
+	Failures int `json:"failures"`
+
+	// When the breaker last opened, if it did.
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, changed func(from, to BreakerState)) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, changed: changed}
+}
+
+// guard calls f unless the breaker is open, and records the outcome. A nil
+// breaker always calls f.
+func (b *circuitBreaker) guard(f func() error) error {
+	if b == nil {
+		return f()
+	}
+
+	probe, err := b.allow()
+	if err != nil {
+		breakerMetrics.rejected.Inc()
+		return err
+	}
+
+	err = f()
+	b.record(err, probe)
+	return err
+}
+
+// allow reports whether a call may go through, and if it is the probe of a
+// half-open breaker.
+func (b *circuitBreaker) allow() (probe bool, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record counts the outcome of a call. Only failures to reach Firestore
+// count; other errors (like a missing key) show it is up.
+func (b *circuitBreaker) record(err error, probe bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	if err == nil || !isUnavailable(err) {
+		b.failures = 0
+		if b.state != BreakerClosed && probe {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if probe || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// setState changes the state. b.m must be held.
+func (b *circuitBreaker) setState(to BreakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	if from == BreakerOpen {
+		breakerMetrics.open.Dec()
+	}
+	if to == BreakerOpen {
+		breakerMetrics.open.Inc()
+		breakerMetrics.opened.Inc()
+	}
+	if b.changed != nil {
+		b.changed(from, to)
+	}
+}
+
+// close takes the breaker out of the metrics, on cleanup.
+func (b *circuitBreaker) close() {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == BreakerOpen {
+		breakerMetrics.open.Dec()
+	}
+	b.state = BreakerClosed
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	b.m.Lock()
+	defer b.m.Unlock()
+	status := BreakerStatus{State: b.state, Failures: b.failures}
+	if !b.openedAt.IsZero() {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// Breaker returns the state of the circuit breaker of this instance. The
+// second result is false if it has none.
+func (s *Storage) Breaker() (BreakerStatus, bool) {
+	if s.breaker == nil {
+		return BreakerStatus{}, false
+	}
+	return s.breaker.status(), true
+}
+
+func (s *Storage) logBreakerChange(from, to BreakerState) {
+	switch to {
+	case BreakerOpen:
+		s.logger.Errorf("firestore circuit breaker opened (was %s), failing calls fast for %ds", from, s.BreakerCooldownSeconds)
+	case BreakerHalfOpen:
+		s.logger.Warnf("firestore circuit breaker half-open, probing")
+	case BreakerClosed:
+		s.logger.Infof("firestore circuit breaker closed, firestore is back")
+	}
+}
@@ -0,0 +1,95 @@
+package storagefirestore
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var changes []BreakerState
+	b := newCircuitBreaker(3, time.Hour, func(from, to BreakerState) {
+		changes = append(changes, to)
+	})
+	opened := testutil.ToFloat64(breakerMetrics.opened)
+	rejected := testutil.ToFloat64(breakerMetrics.rejected)
+
+	down := func() error { return status.Error(codes.Unavailable, "down") }
+	missing := func() error { return status.Error(codes.NotFound, "missing") }
+
+	// Other errors show Firestore is up, and reset the count.
+	assert.Error(t, b.guard(down))
+	assert.Error(t, b.guard(down))
+	assert.Error(t, b.guard(missing))
+	assert.Equal(t, 0, b.status().Failures)
+	assert.Equal(t, BreakerClosed, b.status().State)
+	assert.Nil(t, b.status().OpenedAt)
+
+	// Nor does contention.
+	contended := func() error { return status.Error(codes.Aborted, "contention") }
+	for i := 0; i < 3; i++ {
+		assert.Error(t, b.guard(contended))
+	}
+	assert.Equal(t, BreakerClosed, b.status().State)
+
+	for i := 0; i < 3; i++ {
+		assert.Error(t, b.guard(down))
+	}
+	assert.Equal(t, BreakerOpen, b.status().State)
+	assert.NotNil(t, b.status().OpenedAt)
+	assert.Equal(t, opened+1, testutil.ToFloat64(breakerMetrics.opened))
+
+	called := false
+	err := b.guard(func() error {
+		called = true
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.False(t, called)
+	assert.True(t, isUnavailable(err))
+	assert.Equal(t, rejected+1, testutil.ToFloat64(breakerMetrics.rejected))
+	assert.Equal(t, []BreakerState{BreakerOpen}, changes)
+}
+
+func TestCircuitBreaker_halfOpen(t *testing.T) {
+	b := newCircuitBreaker(1, time.Millisecond, nil)
+	down := func() error { return status.Error(codes.Unavailable, "down") }
+
+	assert.Error(t, b.guard(down))
+	assert.Equal(t, BreakerOpen, b.status().State)
+	time.Sleep(5 * time.Millisecond)
+
+	// A single probe goes through; a failed one opens the breaker again.
+	probe, err := b.allow()
+	assert.True(t, probe)
+	assert.NoError(t, err)
+	assert.Equal(t, BreakerHalfOpen, b.status().State)
+	_, err = b.allow()
+	assert.Equal(t, ErrCircuitOpen, err)
+	b.record(down(), true)
+	assert.Equal(t, BreakerOpen, b.status().State)
+
+	// A successful one closes it.
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, b.guard(func() error { return nil }))
+	assert.Equal(t, BreakerClosed, b.status().State)
+	assert.Equal(t, 0, b.status().Failures)
+}
+
+func TestCircuitBreaker_nil(t *testing.T) {
+	var b *circuitBreaker
+	called := false
+	assert.NoError(t, b.guard(func() error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+
+	s := New()
+	_, ok := s.Breaker()
+	assert.False(t, ok)
+}
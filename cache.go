@@ -0,0 +1,173 @@
+package storagefirestore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A read-through cache of decrypted records, used by Load and Stat when
+// cache_size is set.
+//
+// Entries are dropped when this instance writes the key, when the change
+// feed (changefeed.go) sees another node write it, and after
+// cache_ttl_seconds in case the feed misses something. Expired entries stay
+// until they are evicted, to be served when Firestore is unavailable.
+// Plaintext is zeroed when it leaves the cache.
+
+type recordCache struct {
+	m       sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// Bumped by every invalidation, so a load that raced with one doesn't
+	// cache what it read.
+	gen uint64
+}
+
+type cacheEntry struct {
+	key     string
+	record  *Record
+	expires time.Time
+}
+
+func newRecordCache(size int, ttl time.Duration) *recordCache {
+	return &recordCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the record cached for key. A nil cache always misses.
+func (c *recordCache) get(key string) (*Record, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		cacheMetrics.misses.Inc()
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cacheMetrics.misses.Inc()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	cacheMetrics.hits.Inc()
+	return copyRecord(entry.record), true
+}
+
+// getStale is like get, but also returns expired records.
+func (c *recordCache) getStale(key string) (*Record, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	cacheMetrics.staleHits.Inc()
+	return copyRecord(e.Value.(*cacheEntry).record), true
+}
+
+// generation is to be read before loading a record to put.
+func (c *recordCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.gen
+}
+
+// put caches a copy of record for key, unless an invalidation happened
+// since gen was read.
+func (c *recordCache) put(key string, record *Record, gen uint64) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if gen != c.gen {
+		return
+	}
+
+	if e, found := c.entries[key]; found {
+		c.remove(e)
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		record:  copyRecord(record),
+		expires: time.Now().Add(c.ttl),
+	})
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		cacheMetrics.evictions.Inc()
+	}
+}
+
+// invalidate drops key.
+func (c *recordCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.gen++
+	if e, found := c.entries[key]; found {
+		c.remove(e)
+	}
+}
+
+// clear drops everything.
+func (c *recordCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.gen++
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops e and zeroes its plaintext. c.m must be held.
+func (c *recordCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	zero(entry.record.Raw)
+}
+
+func copyRecord(r *Record) *Record {
+	dup := *r
+	dup.Raw = append([]byte(nil), r.Raw...)
+	return &dup
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
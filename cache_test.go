@@ -0,0 +1,125 @@
+package storagefirestore
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestRecordCache(t *testing.T) {
+	c := newRecordCache(2, time.Minute)
+	hits := testutil.ToFloat64(cacheMetrics.hits)
+	misses := testutil.ToFloat64(cacheMetrics.misses)
+
+	_, found := c.get("a")
+	assert.False(t, found)
+
+	a := &Record{Raw: []byte("secret-a")}
+	c.put("a", a, c.generation())
+	got, found := c.get("a")
+	assert.True(t, found)
+	assert.Equal(t, []byte("secret-a"), got.Raw)
+
+	// Callers get copies.
+	got.Raw[0] = 'X'
+	a.Raw[1] = 'X'
+	got, _ = c.get("a")
+	assert.Equal(t, []byte("secret-a"), got.Raw)
+
+	assert.Equal(t, hits+2, testutil.ToFloat64(cacheMetrics.hits))
+	assert.Equal(t, misses+1, testutil.ToFloat64(cacheMetrics.misses))
+}
+
+func TestRecordCache_evict(t *testing.T) {
+	c := newRecordCache(2, time.Minute)
+	evictions := testutil.ToFloat64(cacheMetrics.evictions)
+
+	c.put("a", &Record{Raw: []byte("a")}, c.generation())
+	c.put("b", &Record{Raw: []byte("b")}, c.generation())
+	c.get("a")
+	cached := c.entries["b"].Value.(*cacheEntry).record
+	c.put("c", &Record{Raw: []byte("c")}, c.generation())
+
+	// The least recently used entry goes, and is zeroed.
+	_, found := c.get("b")
+	assert.False(t, found)
+	assert.Equal(t, []byte{0}, cached.Raw)
+	_, found = c.get("a")
+	assert.True(t, found)
+	assert.Equal(t, evictions+1, testutil.ToFloat64(cacheMetrics.evictions))
+}
+
+func TestRecordCache_expire(t *testing.T) {
+	c := newRecordCache(2, time.Millisecond)
+	c.put("a", &Record{Raw: []byte("a")}, c.generation())
+	time.Sleep(2 * time.Millisecond)
+	_, found := c.get("a")
+	assert.False(t, found)
+
+	// Still there for when Firestore is unavailable.
+	stale, found := c.getStale("a")
+	assert.True(t, found)
+	assert.Equal(t, []byte("a"), stale.Raw)
+	_, found = c.getStale("b")
+	assert.False(t, found)
+}
+
+func TestRecordCache_invalidate(t *testing.T) {
+	c := newRecordCache(2, time.Minute)
+	c.put("a", &Record{Raw: []byte("a")}, c.generation())
+	cached := c.entries["a"].Value.(*cacheEntry).record
+
+	c.invalidate("a")
+	_, found := c.get("a")
+	assert.False(t, found)
+	assert.Equal(t, []byte{0}, cached.Raw)
+
+	// A load that raced with an invalidation isn't cached.
+	gen := c.generation()
+	c.invalidate("b")
+	c.put("b", &Record{Raw: []byte("b")}, gen)
+	_, found = c.get("b")
+	assert.False(t, found)
+
+	c.put("b", &Record{Raw: []byte("b")}, c.generation())
+	c.clear()
+	assert.Empty(t, c.entries)
+}
+
+func TestRecordCache_nil(t *testing.T) {
+	var c *recordCache
+	c.put("a", &Record{Raw: []byte("a")}, c.generation())
+	_, found := c.get("a")
+	assert.False(t, found)
+	c.invalidate("a")
+	c.clear()
+}
+
+func TestStorage_staleReads(t *testing.T) {
+	// With the breaker open, every read serves expired entries.
+	s := New()
+	s.logger = zap.NewNop().Sugar()
+	s.cache = newRecordCache(2, time.Millisecond)
+	s.breaker = newCircuitBreaker(1, time.Hour, nil)
+	s.breaker.guard(func() error { return status.Error(codes.Unavailable, "down") })
+	defer s.breaker.close()
+
+	s.cache.put("a", &Record{Raw: []byte("abc")}, s.cache.generation())
+	time.Sleep(2 * time.Millisecond)
+
+	assert.True(t, s.Exists("a"))
+	info, err := s.Stat("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), info.Size)
+	loaded, err := s.Load("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), loaded)
+
+	assert.False(t, s.Exists("b"))
+	_, err = s.Stat("b")
+	assert.Equal(t, ErrCircuitOpen, err)
+}
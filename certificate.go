@@ -4,9 +4,23 @@ import "time"
 
 type Record struct {
 	Raw       []byte    `firestore:"raw"`
-	Locked    bool      `firestore:"locked"`
-	LockedAt  time.Time `firestore:"lockedAt"`
 	CreatedAt time.Time `firestore:"createdAt"`
 	UpdatedAt time.Time `firestore:"updatedAt"`
+
+	// Fence is the highest fencing number a write to this record carried.
+	Fence int64 `firestore:"fence"`
+
+	// Size of the plaintext, so Stat doesn't have to decrypt. Older
+	// records don't have the field at all, which reads as 0 here like an
+	// empty value does.
+	Size int64 `firestore:"size"`
 }
 
+// hasValue reports whether the record holds stored data.
+//
+// Older versions kept lock state on the record itself and created records
+// without a value when locking a key that did not yet exist. Those
+// placeholders only carry lock state and must read as not existing.
+func (r *Record) hasValue() bool {
+	return len(r.Raw) > 0
+}
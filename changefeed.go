@@ -0,0 +1,236 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"github.com/caddyserver/certmagic"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The change feed follows the records collection with a snapshot listener,
+// so every node learns about writes by the others within moments. It feeds
+// the record cache and OnChange subscribers.
+//
+// The listener starts with a snapshot of the whole collection, which is
+// skipped. If it fails, it is restarted (and the cache cleared); changes in
+// between are missed.
+
+const changeFeedRetryInterval = 5 * time.Second
+
+// ChangeType says how a key changed.
+type ChangeType int
+
+const (
+	KeyCreated ChangeType = iota + 1
+	KeyUpdated
+	KeyDeleted
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case KeyCreated:
+		return "created"
+	case KeyUpdated:
+		return "updated"
+	case KeyDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// ChangeEvent reports a change to a stored key, by any node.
+type ChangeEvent struct {
+	Type ChangeType
+	Key  string
+
+	// Server time of the change.
+	Time time.Time
+}
+
+// OnChange registers f to be called with every change to the stored keys,
+// and starts the change feed if needed. Calls are made one at a time from
+// the feed's goroutine, so f should return quickly.
+func (s *Storage) OnChange(f func(ChangeEvent)) {
+	s.m.Lock()
+	s.onChange = append(s.onChange, f)
+	s.m.Unlock()
+
+	s.startChangeFeed()
+}
+
+// startChangeFeed starts the listener unless it is running.
+func (s *Storage) startChangeFeed() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopFeed != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, s.stopFeed = context.WithCancel(context.Background())
+	go s.watchChanges(ctx)
+}
+
+func (s *Storage) stopChangeFeed() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopFeed != nil {
+		s.stopFeed()
+		s.stopFeed = nil
+	}
+}
+
+// watchChanges runs the listener until ctx is done, restarting it if it
+// fails.
+func (s *Storage) watchChanges(ctx context.Context) {
+	for {
+		err := s.runChangeFeed(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.logger.Warnf("change feed failed, restarting: %v", err)
+		s.cache.clear()
+		if s.sleepOrAbort(ctx, changeFeedRetryInterval) {
+			return
+		}
+	}
+}
+
+func (s *Storage) runChangeFeed(ctx context.Context) error {
+	it := s.client.Collection(s.Collection).Snapshots(ctx)
+	defer it.Stop()
+
+	initial := true
+	for {
+		snapshot, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if initial {
+			initial = false
+			continue
+		}
+
+		for _, change := range snapshot.Changes {
+			key := keyFromSafe(change.Doc.Ref.ID)
+			s.cache.invalidate(key)
+			if change.Kind == firestore.DocumentRemoved {
+				s.sawVersion(key, time.Time{})
+			} else {
+				s.sawVersion(key, change.Doc.UpdateTime)
+			}
+
+			if ev, ok := changeEvent(key, change, snapshot.ReadTime); ok {
+				s.dispatchChange(ev)
+			}
+		}
+	}
+}
+
+// changeEvent converts a document change. Changes to records without a
+// value (see Record.hasValue) are left out.
+func changeEvent(key string, change firestore.DocumentChange, readTime time.Time) (ChangeEvent, bool) {
+	var cert Record
+	if err := change.Doc.DataTo(&cert); err != nil || !cert.hasValue() {
+		return ChangeEvent{}, false
+	}
+
+	ev := ChangeEvent{Key: key, Time: readTime}
+	switch change.Kind {
+	case firestore.DocumentAdded:
+		ev.Type = KeyCreated
+		ev.Time = change.Doc.UpdateTime
+	case firestore.DocumentModified:
+		ev.Type = KeyUpdated
+		ev.Time = change.Doc.UpdateTime
+	case firestore.DocumentRemoved:
+		ev.Type = KeyDeleted
+	default:
+		return ChangeEvent{}, false
+	}
+	return ev, true
+}
+
+func (s *Storage) dispatchChange(ev ChangeEvent) {
+	s.m.Lock()
+	subscribers := s.onChange
+	s.m.Unlock()
+
+	for _, f := range subscribers {
+		f(ev)
+	}
+}
+
+// ReloadCertificates returns an OnChange subscriber that reloads certificates
+// renewed or obtained by other nodes into cache, the certificate cache of
+// the certmagic configurations to update.
+//
+// Certmagic v0.12 can only replace a cached certificate from its maintenance,
+// so this runs cache.RenewManagedCertificates: cached certificates due for
+// renewal whose stored copy was already renewed are swapped for it, and the
+// others due for renewal are renewed, as the next maintenance would do.
+// Reloads run one at a time, after the metadata of a certificate (the last
+// of its keys certmagic writes) changes.
+func (s *Storage) ReloadCertificates(cache *certmagic.Cache) func(ChangeEvent) {
+	r := &certReloader{reload: func() {
+		if err := cache.RenewManagedCertificates(context.Background()); err != nil {
+			s.logger.Warnf("unable to reload certificates: %v", err)
+		}
+	}}
+
+	return func(ev ChangeEvent) {
+		if ev.Type != KeyDeleted && isCertificateMeta(ev.Key) {
+			r.trigger()
+		}
+	}
+}
+
+// certReloader runs reload in the background, once at a time. Triggers
+// while it runs are coalesced into one more run.
+type certReloader struct {
+	reload func()
+
+	m       sync.Mutex
+	running bool
+	pending bool
+}
+
+func (r *certReloader) trigger() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.running {
+		r.pending = true
+		return
+	}
+	r.running = true
+	go r.run()
+}
+
+func (r *certReloader) run() {
+	for {
+		r.reload()
+
+		r.m.Lock()
+		if !r.pending {
+			r.running = false
+			r.m.Unlock()
+			return
+		}
+		r.pending = false
+		r.m.Unlock()
+	}
+}
+
+// isCertificateMeta reports whether key holds the metadata of a certificate,
+// like certificates/<issuer>/<domain>/<domain>.json (see
+// certmagic.KeyBuilder).
+func isCertificateMeta(key string) bool {
+	if !strings.HasPrefix(key, "certificates/") || !strings.HasSuffix(key, ".json") {
+		return false
+	}
+	return path.Base(key) == path.Base(path.Dir(key))+".json"
+}
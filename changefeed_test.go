@@ -0,0 +1,68 @@
+package storagefirestore
+
+import (
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIsCertificateMeta(t *testing.T) {
+	keys := certmagic.KeyBuilder{}
+
+	assert.True(t, isCertificateMeta(keys.SiteMeta("acme-v02", "example.com")))
+	assert.True(t, isCertificateMeta(keys.SiteMeta("acme-v02", "*.example.com")))
+
+	assert.False(t, isCertificateMeta(keys.SiteCert("acme-v02", "example.com")))
+	assert.False(t, isCertificateMeta(keys.SitePrivateKey("acme-v02", "example.com")))
+	assert.False(t, isCertificateMeta("certificates/acme-v02/example.com/other.json"))
+	assert.False(t, isCertificateMeta("acme/acme-v02/users/me/me.json"))
+}
+
+func TestCertReloader(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r := &certReloader{reload: func() {
+		started <- struct{}{}
+		<-release
+	}}
+
+	r.trigger()
+	<-started
+
+	// Triggers during a reload make one more.
+	r.trigger()
+	r.trigger()
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+
+	select {
+	case <-started:
+		t.Fatal("reloaded more than twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.m.Lock()
+	assert.False(t, r.running)
+	r.m.Unlock()
+}
+
+func TestChangeType_String(t *testing.T) {
+	assert.Equal(t, "created", KeyCreated.String())
+	assert.Equal(t, "updated", KeyUpdated.String())
+	assert.Equal(t, "deleted", KeyDeleted.String())
+	assert.Equal(t, "unknown", ChangeType(0).String())
+}
+
+func TestStorage_dispatchChange(t *testing.T) {
+	s := New()
+	var got []ChangeEvent
+	s.m.Lock()
+	s.onChange = append(s.onChange, func(ev ChangeEvent) { got = append(got, ev) })
+	s.m.Unlock()
+
+	ev := ChangeEvent{Type: KeyUpdated, Key: "a"}
+	s.dispatchChange(ev)
+	assert.Equal(t, []ChangeEvent{ev}, got)
+}
@@ -0,0 +1,112 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"os"
+)
+
+// Clients are shared by every config that connects the same way, so a
+// `caddy reload` reuses the connections of the config it replaces instead
+// of opening (and leaking) new ones. A client is closed once the last
+// Storage using it is cleaned up.
+var (
+	firestoreClients = caddy.NewUsagePool()
+	secretClients    = caddy.NewUsagePool()
+)
+
+// clientKey identifies the clients that can be shared.
+type clientKey struct {
+	project  string
+	database string
+
+	// Credentials come from the environment.
+	credentials string
+	emulator    string
+}
+
+func (s *Storage) clientKey() clientKey {
+	return clientKey{
+		project: s.ProjectId,
+		// The only database this client library can use.
+		database:    "(default)",
+		credentials: os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
+		emulator:    os.Getenv("FIRESTORE_EMULATOR_HOST"),
+	}
+}
+
+type pooledFirestoreClient struct {
+	*firestore.Client
+}
+
+func (c pooledFirestoreClient) Destruct() error {
+	return c.Close()
+}
+
+type pooledSecretClient struct {
+	*secretmanager.Client
+}
+
+func (c pooledSecretClient) Destruct() error {
+	return c.Close()
+}
+
+// acquireFirestoreClient gets the shared Firestore client for this instance.
+// It must be released with releaseClients.
+func (s *Storage) acquireFirestoreClient() (*firestore.Client, error) {
+	key := s.clientKey()
+	value, _, err := firestoreClients.LoadOrNew(key, func() (caddy.Destructor, error) {
+		// Not the provisioning context: the client outlives the config.
+		client, err := firestore.NewClient(context.Background(), key.project)
+		if err != nil {
+			return nil, err
+		}
+		return pooledFirestoreClient{client}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.firestoreKey = &key
+	return value.(pooledFirestoreClient).Client, nil
+}
+
+// acquireSecretClient gets the shared Secret Manager client. It must be
+// released with releaseClients.
+func (s *Storage) acquireSecretClient() (*secretmanager.Client, error) {
+	key := s.clientKey()
+	key.project, key.database = "", ""
+	value, _, err := secretClients.LoadOrNew(key, func() (caddy.Destructor, error) {
+		client, err := secretmanager.NewClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return pooledSecretClient{client}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.secretKey = &key
+	return value.(pooledSecretClient).Client, nil
+}
+
+// releaseClients gives up this instance's share of its clients.
+func (s *Storage) releaseClients() error {
+	var firstErr error
+	if s.secretKey != nil {
+		if _, err := secretClients.Delete(*s.secretKey); err != nil {
+			firstErr = err
+		}
+		s.secretKey = nil
+	}
+	if s.firestoreKey != nil {
+		if _, err := firestoreClients.Delete(*s.firestoreKey); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.firestoreKey = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,57 @@
+package storagefirestore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func poolSize() int {
+	n := 0
+	firestoreClients.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestStorage_acquireFirestoreClient(t *testing.T) {
+	// Makes clients without credentials or a network.
+	original, found := os.LookupEnv("FIRESTORE_EMULATOR_HOST")
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	defer func() {
+		if found {
+			os.Setenv("FIRESTORE_EMULATOR_HOST", original)
+		} else {
+			os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+		}
+	}()
+
+	before := poolSize()
+
+	// The old and new configs of a reload share a client.
+	s1, s2, other := New(), New(), New()
+	s1.ProjectId, s2.ProjectId, other.ProjectId = "pool-project", "pool-project", "other-project"
+
+	c1, err := s1.acquireFirestoreClient()
+	assert.NoError(t, err)
+	c2, err := s2.acquireFirestoreClient()
+	assert.NoError(t, err)
+	c3, err := other.acquireFirestoreClient()
+	assert.NoError(t, err)
+
+	assert.Same(t, c1, c2)
+	assert.NotSame(t, c1, c3)
+	assert.Equal(t, before+2, poolSize())
+
+	// Closed once the last user is gone.
+	assert.NoError(t, s1.releaseClients())
+	assert.Equal(t, before+2, poolSize())
+	assert.NoError(t, s2.releaseClients())
+	assert.Equal(t, before+1, poolSize())
+	assert.NoError(t, other.releaseClients())
+	assert.Equal(t, before, poolSize())
+
+	// Releasing twice is harmless.
+	assert.NoError(t, s1.releaseClients())
+}
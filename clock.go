@@ -0,0 +1,49 @@
+package storagefirestore
+
+import (
+	"time"
+)
+
+// How often to repeat the clock skew warning.
+const skewWarningInterval = time.Minute
+
+// observeServerTime compares a time read from the Firestore server with the
+// local clock and warns when they drift apart by more than MaxSkewSeconds.
+//
+// Lock freshness is evaluated entirely with server times (transaction read
+// times and firestore.ServerTimestamp), so skew can no longer make a live
+// lock look stale. The local clock still matters elsewhere, e.g. for
+// certificate renewal windows, so it's worth knowing about.
+func (s *Storage) observeServerTime(serverTime time.Time) {
+	if serverTime.IsZero() || s.MaxSkewSeconds <= 0 {
+		return
+	}
+
+	// The read time is taken before the response travels back, so a
+	// small positive skew is expected.
+	skew := clockSkew(UTCNow(), serverTime)
+	if skew <= time.Duration(s.MaxSkewSeconds)*time.Second {
+		return
+	}
+
+	s.m.Lock()
+	now := UTCNow()
+	shouldWarn := now.Sub(s.lastSkewWarning) >= skewWarningInterval
+	if shouldWarn {
+		s.lastSkewWarning = now
+	}
+	s.m.Unlock()
+
+	if shouldWarn && s.logger != nil {
+		s.logger.Warnf("local clock is %s off from Firestore server time", skew)
+	}
+}
+
+// clockSkew is the absolute difference between local and server.
+func clockSkew(local, server time.Time) time.Duration {
+	skew := local.Sub(server)
+	if skew < 0 {
+		return -skew
+	}
+	return skew
+}
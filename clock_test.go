@@ -0,0 +1,49 @@
+package storagefirestore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+	"time"
+)
+
+func TestStorage_observeServerTime(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s := New()
+	s.logger = zap.New(core).Sugar()
+
+	// Within bounds.
+	s.observeServerTime(UTCNow())
+	s.observeServerTime(UTCNow().Add(-time.Second))
+	assert.Equal(t, 0, logs.Len())
+
+	// Zero times are ignored.
+	s.observeServerTime(time.Time{})
+	assert.Equal(t, 0, logs.Len())
+
+	// Drifting either direction warns, but only once per interval.
+	s.observeServerTime(UTCNow().Add(time.Minute))
+	assert.Equal(t, 1, logs.Len())
+	s.observeServerTime(UTCNow().Add(-time.Minute))
+	assert.Equal(t, 1, logs.Len())
+
+	s.lastSkewWarning = UTCNow().Add(-skewWarningInterval)
+	s.observeServerTime(UTCNow().Add(-time.Minute))
+	assert.Equal(t, 2, logs.Len())
+	assert.Contains(t, logs.All()[1].Message, "off from Firestore server time")
+
+	// Disabled.
+	s.MaxSkewSeconds = 0
+	s.lastSkewWarning = time.Time{}
+	s.observeServerTime(UTCNow().Add(time.Hour))
+	assert.Equal(t, 2, logs.Len())
+}
+
+func TestClockSkew(t *testing.T) {
+	now := UTCNow()
+	assert.Equal(t, time.Second, clockSkew(now, now.Add(time.Second)))
+	assert.Equal(t, time.Second, clockSkew(now.Add(time.Second), now))
+	assert.Equal(t, time.Duration(0), clockSkew(now, now))
+}
@@ -0,0 +1,156 @@
+package storagefirestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "firestore",
+		Func:  cmdFirestore,
+		Usage: "unlock [--address <interface>] [--token <token>] [--by <name>] --reason <text> [--force] <key>",
+		Short: "Manages the Firestore storage of a running Caddy instance",
+		Long: `
+Manages the Firestore storage of a running Caddy instance through its admin API.
+
+The unlock subcommand force unlocks <key>, regardless of which node holds it.
+Use it when a node died while holding a lock you can't wait out. Who forced
+it (--by, defaulting to the current user) and why (--reason) are recorded
+on the lock.
+
+Locks held for less than the configured min_force_unlock_seconds are refused
+unless --force is given.
+
+The request must carry the storage's admin_token, given with --token or the
+` + EnvNameAdminToken + ` environment variable.
+`,
+	})
+}
+
+func cmdFirestore(fl caddycmd.Flags) (int, error) {
+	args := fl.Args()
+	if len(args) == 0 || args[0] != "unlock" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown subcommand; usage: caddy firestore unlock [flags] <key>")
+	}
+
+	fs := flag.NewFlagSet("firestore unlock", flag.ContinueOnError)
+	address := fs.String("address", caddy.DefaultAdminListen, "The address to which Caddy's admin API listens")
+	token := fs.String("token", os.Getenv(EnvNameAdminToken), "The storage's admin_token")
+	by := fs.String("by", defaultUnlockedBy(), "Who is forcing the unlock")
+	reason := fs.String("reason", "", "Why the lock is being forced (required)")
+	force := fs.Bool("force", false, "Unlock even if the lock is younger than min_force_unlock_seconds")
+	if err := fs.Parse(args[1:]); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if fs.NArg() != 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("exactly one key is required")
+	}
+	if *reason == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--reason is required")
+	}
+
+	body, err := json.Marshal(forceUnlockRequest{
+		Key:    fs.Arg(0),
+		By:     *by,
+		Reason: *reason,
+		Force:  *force,
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	respBody, err := adminRequest(*address, *token, http.MethodPost, "/firestore/locks/unlock", body)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var info LockInfo
+	if err := json.Unmarshal(respBody, &info); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+
+	fmt.Printf("Unlocked %s, held by %s since %s\n", info.Key, info.Holder, info.AcquiredAt)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// adminRequest makes a request to the admin API listening on adminAddr.
+// Like caddy's own commands, it sets the Origin header the admin API
+// expects.
+func adminRequest(adminAddr, token, method, uri string, body []byte) ([]byte, error) {
+	parsedAddr, err := caddy.ParseNetworkAddress(adminAddr)
+	if err != nil || parsedAddr.PortRangeSize() > 1 {
+		return nil, fmt.Errorf("invalid admin address %s: %v", adminAddr, err)
+	}
+	origin := parsedAddr.JoinHostPort(0)
+	if parsedAddr.IsUnixNetwork() {
+		origin = "unixsocket"
+	}
+
+	req, err := http.NewRequest(method, "http://"+origin+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("making request: %v", err)
+	}
+	if parsedAddr.IsUnixNetwork() {
+		// The admin API only accepts an empty Host on unix sockets.
+		req.URL.Host = " "
+		req.Host = ""
+	} else {
+		req.Header.Set("Origin", origin)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial(parsedAddr.Network, parsedAddr.JoinHostPort(0))
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		var apiErr caddy.APIError
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("caddy responded with error: HTTP %d: %s", resp.StatusCode, apiErr.Message)
+		}
+		return nil, fmt.Errorf("caddy responded with error: HTTP %d: %s", resp.StatusCode, respBody)
+	}
+
+	return respBody, nil
+}
+
+// defaultUnlockedBy is user@hostname of whoever runs the command.
+func defaultUnlockedBy() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return user
+	}
+	return user + "@" + hostname
+}
@@ -0,0 +1,63 @@
+package storagefirestore
+
+import (
+	"encoding/json"
+	"flag"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func firestoreFlags(t *testing.T, args ...string) caddycmd.Flags {
+	fs := flag.NewFlagSet("firestore", flag.ContinueOnError)
+	assert.NoError(t, fs.Parse(args))
+	return caddycmd.Flags{FlagSet: fs}
+}
+
+func TestCmdFirestore(t *testing.T) {
+	var got forceUnlockRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/firestore/locks/unlock", r.URL.Path)
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NotEmpty(t, r.Header.Get("Origin"))
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid admin token"}`))
+			return
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		_ = json.NewEncoder(w).Encode(&LockInfo{Key: got.Key, Holder: "other-node"})
+	}))
+	defer srv.Close()
+	address := strings.TrimPrefix(srv.URL, "http://")
+
+	code, err := cmdFirestore(firestoreFlags(t, "unlock", "--address", address, "--token", "secret",
+		"--by", "operator", "--reason", "node died", "--force", "cert_acme_example.com_acme-v02.api.letsencrypt.org-directory"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, forceUnlockRequest{
+		Key:    "cert_acme_example.com_acme-v02.api.letsencrypt.org-directory",
+		By:     "operator",
+		Reason: "node died",
+		Force:  true,
+	}, got)
+
+	// API errors are surfaced.
+	_, err = cmdFirestore(firestoreFlags(t, "unlock", "--address", address, "--token", "wrong",
+		"--reason", "node died", "cert_acme_example.com_acme-v02.api.letsencrypt.org-directory"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "HTTP 401: invalid admin token")
+
+	// Bad usage.
+	_, err = cmdFirestore(firestoreFlags(t))
+	assert.Error(t, err)
+	_, err = cmdFirestore(firestoreFlags(t, "lock", "key"))
+	assert.Error(t, err)
+	_, err = cmdFirestore(firestoreFlags(t, "unlock", "--reason", "why"))
+	assert.Contains(t, err.Error(), "exactly one key")
+	_, err = cmdFirestore(firestoreFlags(t, "unlock", "key"))
+	assert.Contains(t, err.Error(), "--reason is required")
+}
@@ -29,6 +29,10 @@ func (s *Storage) decrypt(ciphertext []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("decryption failure: ciphertext too short")
+	}
+
 	out, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
 	if err != nil {
 		return nil, fmt.Errorf("decryption failure: %w", err)
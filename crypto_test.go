@@ -30,3 +30,15 @@ func TestStorage_encrypt(t *testing.T) {
 	assert.Contains(t, err.Error(), "message authentication failed")
 	assert.Nil(t, got)
 }
+
+func TestStorage_decryptShortCiphertext(t *testing.T) {
+	s := New()
+	s.AesKey = []byte("0123456789abcdef")
+
+	for _, ciphertext := range [][]byte{nil, {}, []byte("short")} {
+		got, err := s.decrypt(ciphertext)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "ciphertext too short")
+		assert.Nil(t, got)
+	}
+}
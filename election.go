@@ -0,0 +1,225 @@
+package storagefirestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Leader election for cluster-singleton tasks.
+//
+// Campaigning nodes all try to take the same lock (see locker.go), in a
+// namespace of the LockApp reserved for elections. Whoever holds it leads,
+// keeping it fresh like any other lock, until it loses it or shuts down.
+// The others wait on the lock listener and take over once it is released
+// or goes stale. The lock document doubles as the leader record.
+
+// ErrNoLeader is returned by Election.Leader while nobody leads.
+var ErrNoLeader = errors.New("no leader elected")
+
+// electionNamespace can't clash with Namespace, which rejects names
+// starting with an underscore.
+const electionNamespace = "_elections"
+
+// How long to wait before campaigning again after an error.
+const campaignRetryInterval = 5 * time.Second
+
+// Election elects one leader among the nodes campaigning under the same
+// name. Get it from LockApp.Election.
+type Election struct {
+	name string
+	ns   *LockNamespace
+
+	m         sync.Mutex
+	leading   bool
+	term      context.Context
+	endTerm   context.CancelFunc
+	onElected []func(term context.Context)
+	onDemoted []func()
+
+	// Callbacks waiting to run, in order, and whether a goroutine is
+	// running them.
+	pending     []func()
+	dispatching bool
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// LeaderInfo describes the current leader of an election.
+type LeaderInfo struct {
+	// Owner ID and hostname of the leader's instance.
+	Holder   string    `json:"holder"`
+	Hostname string    `json:"hostname"`
+	Since    time.Time `json:"since"`
+
+	// Increases with every new term.
+	Term int64 `json:"term"`
+}
+
+func newElection(name string, ns *LockNamespace) *Election {
+	return &Election{name: name, ns: ns}
+}
+
+// IsLeader reports whether this node currently leads.
+func (e *Election) IsLeader() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.leading
+}
+
+// OnElected registers f to run when this node becomes the leader, or right
+// away if it already is. term is done once the node stops leading, so
+// tasks started by f should stop with it.
+//
+// Callbacks run one at a time, in the order of the events, in a goroutine
+// of the election. They should return quickly.
+func (e *Election) OnElected(f func(term context.Context)) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.onElected = append(e.onElected, f)
+	if e.leading {
+		term := e.term
+		e.dispatch(func() { f(term) })
+	}
+}
+
+// OnDemoted registers f to run when this node stops leading.
+func (e *Election) OnDemoted(f func()) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.onDemoted = append(e.onDemoted, f)
+}
+
+// Leader reads the leader record. It returns ErrNoLeader if nobody leads.
+func (e *Election) Leader() (*LeaderInfo, error) {
+	info, err := e.ns.LockInfo(e.name)
+	if errors.Is(err, ErrLockNotFound) {
+		return nil, ErrNoLeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Stale {
+		return nil, ErrNoLeader
+	}
+
+	return &LeaderInfo{
+		Holder:   info.Holder,
+		Hostname: info.Hostname,
+		Since:    info.AcquiredAt,
+		Term:     info.Fence,
+	}, nil
+}
+
+// start campaigns until ctx is done or stop is called.
+func (e *Election) start(ctx context.Context) {
+	ctx, e.stop = context.WithCancel(ctx)
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		e.campaign(ctx)
+	}()
+}
+
+// close stops campaigning and steps down, waiting for the lock to be
+// released.
+func (e *Election) close() {
+	if e.stop != nil {
+		e.stop()
+		<-e.done
+	}
+}
+
+func (e *Election) campaign(ctx context.Context) {
+	logger := e.ns.s.logger
+	for {
+		if err := e.ns.Lock(ctx, e.name); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warnf("unable to campaign for leader of %s, retrying: %v", e.name, err)
+			if e.ns.s.sleepOrAbort(ctx, campaignRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		logger.Infof("elected leader of %s", e.name)
+		e.elect()
+
+		lost, _ := e.ns.LockLost(e.name)
+		select {
+		case <-lost:
+			logger.Warnf("lost leadership of %s", e.name)
+		case <-ctx.Done():
+		}
+		e.demote()
+
+		// Unlocking a lost lock is expected to fail.
+		if err := e.ns.Unlock(e.name); err != nil && ctx.Err() != nil {
+			logger.Warnf("unable to step down as leader of %s: %v", e.name, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (e *Election) elect() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.leading = true
+	e.term, e.endTerm = context.WithCancel(context.Background())
+
+	callbacks, term := e.onElected, e.term
+	e.dispatch(func() {
+		for _, f := range callbacks {
+			f(term)
+		}
+	})
+}
+
+func (e *Election) demote() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if !e.leading {
+		return
+	}
+	e.leading = false
+	e.endTerm()
+
+	callbacks := e.onDemoted
+	e.dispatch(func() {
+		for _, f := range callbacks {
+			f()
+		}
+	})
+}
+
+// dispatch queues f to run after the callbacks queued before it. e.m must
+// be held, so that events and registrations are queued in order.
+func (e *Election) dispatch(f func()) {
+	e.pending = append(e.pending, f)
+	if !e.dispatching {
+		e.dispatching = true
+		go e.runCallbacks()
+	}
+}
+
+func (e *Election) runCallbacks() {
+	for {
+		e.m.Lock()
+		if len(e.pending) == 0 {
+			e.dispatching = false
+			e.m.Unlock()
+			return
+		}
+		f := e.pending[0]
+		e.pending = e.pending[1:]
+		e.m.Unlock()
+
+		f()
+	}
+}
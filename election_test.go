@@ -0,0 +1,66 @@
+package storagefirestore
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestElection_callbacks(t *testing.T) {
+	e := newElection("maintenance", nil)
+	assert.False(t, e.IsLeader())
+
+	terms := make(chan context.Context, 10)
+	demotions := make(chan struct{}, 10)
+	e.OnElected(func(term context.Context) { terms <- term })
+	e.OnDemoted(func() { demotions <- struct{}{} })
+
+	e.elect()
+	assert.True(t, e.IsLeader())
+	term := <-terms
+	assert.NoError(t, term.Err())
+
+	// Late registrations run right away while leading.
+	late := make(chan context.Context, 10)
+	e.OnElected(func(term context.Context) { late <- term })
+	assert.Equal(t, term, <-late)
+
+	e.demote()
+	assert.False(t, e.IsLeader())
+	<-demotions
+	assert.Error(t, term.Err())
+
+	// Demoting twice doesn't call back twice.
+	e.demote()
+
+	e.elect()
+	assert.NoError(t, (<-terms).Err())
+	<-late
+	assert.Len(t, demotions, 0)
+	assert.Len(t, terms, 0)
+	assert.Len(t, late, 0)
+}
+
+func TestElection_registrationRace(t *testing.T) {
+	// Registering while being elected calls back exactly once.
+	for i := 0; i < 100; i++ {
+		e := newElection("race", nil)
+		calls := make(chan struct{}, 2)
+		go e.elect()
+		e.OnElected(func(context.Context) { calls <- struct{}{} })
+
+		<-calls
+		select {
+		case <-calls:
+			assert.Fail(t, "called back twice")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestLockApp_ElectionNotRunning(t *testing.T) {
+	app := &LockApp{Storage: New()}
+	_, err := app.Election("maintenance")
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"errors"
+	"github.com/caddyserver/certmagic"
+	"strings"
+)
+
+// ErrStaleFence is returned by Store and Delete when the write carries an
+// older fencing number than the one currently recorded for the key.
+var ErrStaleFence = errors.New("write fenced off by a newer lock holder")
+
+// Fencing numbers protect against split-brain renewals.
+//
+// Ownership tokens stop a holder whose lock was taken over from refreshing
+// or releasing it. They do not stop it from writing: a process can pause
+// (GC, VM migration, ...), resume after its lock went stale and someone else
+// acquired it, and still call Store. Every successful Lock therefore gets a
+// number one larger than any previous holder of the lock had. Writes carry
+// the number of the held lock guarding their key (see guardingLock), and
+// are rejected if a newer number has been handed out for that lock, or
+// recorded on the data record.
+//
+// The last number handed out for a lock is kept in a counter document
+// below its lock document. The TTL policy of the lock collection removes
+// lock documents but not their subcollections, so the counter survives and
+// fences never go back, even for locks without a record of the same name.
+
+// certmagic (v0.12) obtains and renews the certificate of a name under the
+// lock "cert_acme_<name>_<issuer key>", and stores it under
+// KeyBuilder.CertsSitePrefix(<issuer key>, <name>).
+const certmagicLockPrefix = "cert_acme_"
+
+// Fence returns the fencing number of the lock this instance holds on key.
+func (s *Storage) Fence(key string) (int64, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if held, found := s.locks[key]; found {
+		return held.fence, true
+	}
+	return 0, false
+}
+
+// heldFence returns the held lock guarding writes to key and its fencing
+// number, or zero if there is none.
+func (s *Storage) heldFence(key string) (string, int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for name, held := range s.locks {
+		if guardingLock(name, key) {
+			return name, held.fence
+		}
+	}
+	return "", 0
+}
+
+// guardingLock reports whether holding the lock name guards writes to key:
+// either it has the same name, or it is the certmagic lock of the
+// certificate key belongs to.
+func guardingLock(name, key string) bool {
+	if name == key {
+		return true
+	}
+	if !strings.HasPrefix(name, certmagicLockPrefix) {
+		return false
+	}
+
+	// Names and issuer keys may both contain underscores, so try every
+	// split.
+	rest := strings.TrimPrefix(name, certmagicLockPrefix)
+	for i := 0; i < len(rest); i++ {
+		if rest[i] != '_' {
+			continue
+		}
+		prefix := certmagic.KeyBuilder{}.CertsSitePrefix(rest[i+1:], rest[:i])
+		if strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fenceRef is the counter of the fencing numbers handed out for the lock
+// named key.
+func (s *Storage) fenceRef(key string) *firestore.DocumentRef {
+	return s.lockRef(key).Collection("fence").Doc("last")
+}
+
+// fenceCounter is the document at fenceRef.
+type fenceCounter struct {
+	Fence int64 `firestore:"fence"`
+}
+
+// lastFence reads the last fencing number handed out for the lock named
+// key in t.
+func (s *Storage) lastFence(t *firestore.Transaction, key string) (int64, error) {
+	doc, err := t.Get(s.fenceRef(key))
+	if err != nil {
+		if IsDocNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var counter fenceCounter
+	if err := doc.DataTo(&counter); err != nil {
+		return 0, err
+	}
+	return counter.Fence, nil
+}
+
+// nextFence reads the fence counter and the data record for key in t and
+// returns the fencing number for a new acquisition. lockFence is the
+// number on the current lock document, if any, which is all older
+// versions kept. The caller must record it with setFence.
+func (s *Storage) nextFence(t *firestore.Transaction, key string, lockFence int64) (int64, error) {
+	fence, err := s.lastFence(t, key)
+	if err != nil {
+		return 0, err
+	}
+	if lockFence > fence {
+		fence = lockFence
+	}
+
+	doc, err := t.Get(s.keyToRef(key))
+	if err != nil && !IsDocNotFound(err) {
+		return 0, err
+	}
+	if err == nil {
+		var cert Record
+		if err := doc.DataTo(&cert); err != nil {
+			return 0, err
+		}
+		if cert.Fence > fence {
+			fence = cert.Fence
+		}
+	}
+
+	return fence + 1, nil
+}
+
+// setFence records fence as the last one handed out for the lock named key.
+func (s *Storage) setFence(t *firestore.Transaction, key string, fence int64) error {
+	return t.Set(s.fenceRef(key), fenceCounter{Fence: fence})
+}
+
+// checkFence rejects a write carrying fence, taken from the lock named
+// lockName, if a newer one was handed out since. Unfenced writes (zero)
+// are not checked.
+func (s *Storage) checkFence(t *firestore.Transaction, lockName string, fence int64) error {
+	if fence == 0 {
+		return nil
+	}
+
+	last, err := s.lastFence(t, lockName)
+	if err != nil {
+		return err
+	}
+
+	// Locks taken by older versions only recorded their fence on the lock
+	// document.
+	doc, err := t.Get(s.lockRef(lockName))
+	if err != nil && !IsDocNotFound(err) {
+		return err
+	}
+	if err == nil {
+		var lock LockRecord
+		if err := doc.DataTo(&lock); err != nil {
+			return err
+		}
+		if lock.Fence > last {
+			last = lock.Fence
+		}
+	}
+
+	if last > fence {
+		return ErrStaleFence
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package storagefirestore
+
+import (
+	"fmt"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGuardingLock(t *testing.T) {
+	issuer := "acme-v02.api.letsencrypt.org-directory"
+	keys := certmagic.KeyBuilder{}
+
+	// As named by certmagic's Config.lockKey.
+	lock := fmt.Sprintf("cert_acme_%s_%s", "example.com", issuer)
+	assert.True(t, guardingLock(lock, keys.SiteCert(issuer, "example.com")))
+	assert.True(t, guardingLock(lock, keys.SitePrivateKey(issuer, "example.com")))
+	assert.True(t, guardingLock(lock, keys.SiteMeta(issuer, "example.com")))
+	assert.False(t, guardingLock(lock, keys.SiteCert(issuer, "example.org")))
+	assert.False(t, guardingLock(lock, keys.SiteCert(issuer, "example.com.evil")))
+	assert.False(t, guardingLock(lock, keys.SiteCert("other-issuer", "example.com")))
+
+	wildcard := fmt.Sprintf("cert_acme_%s_%s", "*.example.com", issuer)
+	assert.True(t, guardingLock(wildcard, keys.SiteCert(issuer, "*.example.com")))
+
+	// Underscores in the issuer key.
+	underscored := fmt.Sprintf("cert_acme_%s_%s", "example.com", "my_ca")
+	assert.True(t, guardingLock(underscored, keys.SiteCert("my_ca", "example.com")))
+
+	// Other locks only guard their own name.
+	assert.True(t, guardingLock("some/key", "some/key"))
+	assert.False(t, guardingLock("some/key", "some/key/below"))
+}
@@ -0,0 +1,70 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/certmagic"
+	"time"
+)
+
+// ErrLockTooYoung is returned by ForceUnlock when the lock hasn't been held
+// for MinForceUnlockSeconds and force isn't set.
+var ErrLockTooYoung = errors.New("lock is too young to force unlock")
+
+// ForceUnlock releases the lock on key regardless of who holds it.
+//
+// It is meant for operators cleaning up after a node died mid-renewal. The
+// lock document records who forced it and why until its TTL removes it.
+// Unless force is set, locks held for less than MinForceUnlockSeconds are
+// left alone. The previous holder, if still alive, finds out on its next
+// refresh (see LockLost), and its writes are fenced off once someone else
+// locks the key.
+//
+// It returns the lock as it was before being released.
+func (s *Storage) ForceUnlock(key, by, reason string, force bool) (*LockInfo, error) {
+	var info *LockInfo
+	ref := s.lockRef(key)
+
+	err := s.client.RunTransaction(context.Background(), func(ctx context.Context, t *firestore.Transaction) error {
+		doc, err := t.Get(ref)
+		if err != nil {
+			if IsDocNotFound(err) {
+				return certmagic.ErrNotExist(fmt.Errorf("%w: %s", ErrLockNotFound, key))
+			}
+			return err
+		}
+
+		var lock LockRecord
+		if err := doc.DataTo(&lock); err != nil {
+			return err
+		}
+		if lock.Released {
+			return certmagic.ErrNotExist(fmt.Errorf("%w: %s", ErrLockNotFound, key))
+		}
+
+		info = s.lockInfo(key, &lock, doc.ReadTime)
+		if age := doc.ReadTime.Sub(lock.LockedAt); !force && age < s.minForceUnlockAge() {
+			return fmt.Errorf("%w: %s held for %s", ErrLockTooYoung, key, age)
+		}
+
+		return t.Update(ref, []firestore.Update{
+			{Path: "released", Value: true},
+			{Path: "forcedBy", Value: by},
+			{Path: "forcedReason", Value: reason},
+			{Path: "forcedAt", Value: firestore.ServerTimestamp},
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Warnf("lock %s held by %s was force unlocked by %s: %s", key, info.Holder, by, reason)
+	return info, nil
+}
+
+func (s *Storage) minForceUnlockAge() time.Duration {
+	return time.Duration(s.MinForceUnlockSeconds) * time.Second
+}
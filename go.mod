@@ -7,8 +7,10 @@ require (
 	cloud.google.com/go/firestore v1.3.0
 	github.com/caddyserver/caddy/v2 v2.2.0
 	github.com/caddyserver/certmagic v0.12.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/stretchr/testify v1.5.1
 	go.uber.org/zap v1.15.0
+	google.golang.org/api v0.29.0
 	google.golang.org/genproto v0.0.0-20200806141610-86f49bd18e98
 	google.golang.org/grpc v1.30.0
 )
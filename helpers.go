@@ -1,6 +1,11 @@
 package storagefirestore
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"time"
@@ -10,6 +15,26 @@ func IsDocNotFound(err error) bool {
 	return status.Code(err) == codes.NotFound
 }
 
+// isUnavailable reports whether err means Firestore couldn't be reached or
+// didn't answer, so the request may succeed later. Aborted transactions are
+// left out: they only mean contention, which Firestore is up to report.
+func isUnavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCircuitOpen)
+}
+
 func UTCNow() time.Time {
 	return time.Now().UTC().Truncate(time.Millisecond)
 }
+
+// randomToken returns a random hex string suitable for lock ownership.
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
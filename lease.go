@@ -0,0 +1,72 @@
+package storagefirestore
+
+import (
+	"errors"
+	"time"
+)
+
+// Bounds on how long a lock can be held.
+//
+// Refreshing keeps a lock alive for as long as its holder runs, which is
+// forever for a holder stuck in a retry loop. With MaxLockHoldSeconds set,
+// every acquisition records a leaseUntil deadline on the lock document.
+// Past it, the lock is expired for every node, whatever their own
+// configuration, and the holder marks it lost. Fencing (fence.go) rejects
+// any write the holder still attempts afterwards.
+//
+// Independently, holders log a warning and count a long hold once they have
+// held a lock for LongHoldWarningSeconds.
+
+// errLeaseExpired is the cause of losing a lock held past its lease.
+var errLeaseExpired = errors.New("lock held past its maximum lease")
+
+// leaseExpired reports whether lock was held past its lease at the server
+// time now.
+func (lock *LockRecord) leaseExpired(now time.Time) bool {
+	return !lock.LeaseUntil.IsZero() && !now.Before(lock.LeaseUntil)
+}
+
+// isExpired reports whether lock is free to take over at the server time
+// now, because it went stale or ran out its lease.
+func (s *Storage) isExpired(lock *LockRecord, now time.Time) bool {
+	return s.isStale(lock.RefreshedAt, now) || lock.leaseExpired(now)
+}
+
+// expiryOf is when lock expires unless refreshed.
+func (s *Storage) expiryOf(lock *LockRecord) time.Time {
+	expiry := s.expiresAt(lock.RefreshedAt)
+	if !lock.LeaseUntil.IsZero() && lock.LeaseUntil.Before(expiry) {
+		return lock.LeaseUntil
+	}
+	return expiry
+}
+
+// maxHold is the maximum lease, or 0 if unlimited.
+func (s *Storage) maxHold() time.Duration {
+	return time.Duration(s.MaxLockHoldSeconds) * time.Second
+}
+
+// checkLongHold warns, once per acquisition, about a lock held for longer
+// than LongHoldWarningSeconds.
+func (s *Storage) checkLongHold(key string, held *heldLock) {
+	threshold := time.Duration(s.LongHoldWarningSeconds) * time.Second
+	if threshold <= 0 {
+		return
+	}
+
+	heldFor := time.Since(held.acquiredAt)
+	if heldFor < threshold {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if held.longHeld {
+		return
+	}
+	held.longHeld = true
+
+	lockMetrics.longHolds.Inc()
+	lockMetrics.longHeld.Inc()
+	s.logger.Warnf("lock %s held for %s, longer than %s", key, heldFor.Round(time.Second), threshold)
+}
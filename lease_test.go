@@ -0,0 +1,54 @@
+package storagefirestore
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestStorage_isExpired(t *testing.T) {
+	s := Storage{FreshnessSeconds: 60}
+	now := UTCNow()
+
+	lock := &LockRecord{RefreshedAt: now}
+	assert.False(t, s.isExpired(lock, now))
+	assert.Equal(t, now.Add(120*time.Second), s.expiryOf(lock))
+
+	// Refreshed, but past its lease.
+	lock.LeaseUntil = now.Add(10 * time.Second)
+	assert.False(t, s.isExpired(lock, now.Add(9*time.Second)))
+	assert.True(t, s.isExpired(lock, now.Add(10*time.Second)))
+	assert.Equal(t, lock.LeaseUntil, s.expiryOf(lock))
+
+	// Stale before its lease ends.
+	lock.LeaseUntil = now.Add(time.Hour)
+	assert.True(t, s.isExpired(lock, now.Add(121*time.Second)))
+	assert.Equal(t, now.Add(120*time.Second), s.expiryOf(lock))
+}
+
+func TestStorage_checkLongHold(t *testing.T) {
+	s := New()
+	s.logger = zap.NewNop().Sugar()
+	s.LongHoldWarningSeconds = 60
+	key := "long-hold"
+
+	held := newHeldLock("token", 1)
+	s.lockLocal(key, held)
+
+	before := testutil.ToFloat64(lockMetrics.longHolds)
+	held0 := testutil.ToFloat64(lockMetrics.longHeld)
+	s.checkLongHold(key, held)
+	assert.False(t, held.longHeld)
+
+	held.acquiredAt = held.acquiredAt.Add(-time.Minute)
+	s.checkLongHold(key, held)
+	s.checkLongHold(key, held)
+	assert.True(t, held.longHeld)
+	assert.Equal(t, before+1, testutil.ToFloat64(lockMetrics.longHolds))
+	assert.Equal(t, held0+1, testutil.ToFloat64(lockMetrics.longHeld))
+
+	s.unlockLocal(key)
+	assert.Equal(t, held0, testutil.ToFloat64(lockMetrics.longHeld))
+}
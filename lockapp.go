@@ -0,0 +1,201 @@
+package storagefirestore
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(&LockApp{})
+}
+
+// DefaultAppLockCollection keeps the locks of the app apart from the
+// certmagic locks of the storage module.
+const DefaultAppLockCollection = "caddy_locks"
+
+// LockApp makes the Firestore locker available to other modules for
+// cluster-wide mutual exclusion. Modules get it with ctx.App and lock keys
+// in a named namespace,
+//
+//	app, err := ctx.App("firestore_locks")
+//	...
+//	jobs, err := app.(*storagefirestore.LockApp).Namespace("cron")
+//	...
+//	if err := jobs.Lock(ctx, "nightly-report"); err != nil {
+//
+// It is configured like the storage module, except that locks go to the
+// caddy_locks collection by default. The AES key settings are not needed.
+type LockApp struct {
+	Storage *Storage `json:"storage,omitempty"`
+
+	ctx       context.Context
+	m         sync.Mutex
+	elections map[string]*Election
+}
+
+func (*LockApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "firestore_locks",
+		New: func() caddy.Module {
+			s := New()
+			s.LockCollection = DefaultAppLockCollection
+			return &LockApp{Storage: s}
+		},
+	}
+}
+
+func (a *LockApp) Provision(ctx caddy.Context) error {
+	if a.Storage == nil {
+		a.Storage = New()
+		a.Storage.LockCollection = DefaultAppLockCollection
+	}
+
+	a.ctx = ctx
+	a.elections = map[string]*Election{}
+
+	s := a.Storage
+	s.logger = ctx.Logger(a).Sugar()
+	if err := s.loadOverrides(ctx); err != nil {
+		return err
+	}
+	if err := s.setupAfterProvision(ctx); err != nil {
+		return err
+	}
+
+	// Makes the locks visible to the admin API.
+	registerStorage(s)
+	return nil
+}
+
+func (a *LockApp) Start() error {
+	return nil
+}
+
+func (a *LockApp) Stop() error {
+	return nil
+}
+
+// Cleanup steps down from elections and releases the locks still held
+// (see Storage.Cleanup).
+func (a *LockApp) Cleanup() error {
+	a.m.Lock()
+	elections := a.elections
+	a.elections = nil
+	a.m.Unlock()
+
+	for _, e := range elections {
+		e.close()
+	}
+	return a.Storage.Cleanup()
+}
+
+// Election returns the election named name, and starts campaigning for it
+// on first use. This node campaigns until Caddy stops or reloads.
+func (a *LockApp) Election(name string) (*Election, error) {
+	if name == "" {
+		return nil, fmt.Errorf("invalid election name %q", name)
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.elections == nil {
+		return nil, fmt.Errorf("lock app is not running")
+	}
+
+	if e, found := a.elections[name]; found {
+		return e, nil
+	}
+
+	e := newElection(name, a.namespace(electionNamespace))
+	e.start(a.ctx)
+	a.elections[name] = e
+	return e, nil
+}
+
+// Namespace returns the locks named name. Keys in different namespaces
+// never conflict.
+func (a *LockApp) Namespace(name string) (*LockNamespace, error) {
+	// Leading underscores are reserved for internal use. Slashes become
+	// backslashes in document IDs (see firestoreSafeKey), so neither may
+	// appear: "a\b" could then collide with key "b/..." of namespace "a".
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, "_") {
+		return nil, fmt.Errorf("invalid lock namespace %q", name)
+	}
+	return a.namespace(name), nil
+}
+
+func (a *LockApp) namespace(name string) *LockNamespace {
+	return &LockNamespace{name: name, prefix: name + "/", s: a.Storage}
+}
+
+// LockNamespace is a set of locks of the LockApp. Its methods behave like
+// those of Storage with the same names.
+type LockNamespace struct {
+	name   string
+	prefix string
+	s      *Storage
+}
+
+// Name of the namespace.
+func (n *LockNamespace) Name() string {
+	return n.name
+}
+
+func (n *LockNamespace) Lock(ctx context.Context, key string) error {
+	return n.s.Lock(ctx, n.prefix+key)
+}
+
+func (n *LockNamespace) TryLock(ctx context.Context, key string) (bool, error) {
+	return n.s.TryLock(ctx, n.prefix+key)
+}
+
+func (n *LockNamespace) LockWithTimeout(ctx context.Context, key string, timeout time.Duration) error {
+	return n.s.LockWithTimeout(ctx, n.prefix+key, timeout)
+}
+
+func (n *LockNamespace) Unlock(key string) error {
+	return n.s.Unlock(n.prefix + key)
+}
+
+func (n *LockNamespace) LockLost(key string) (<-chan struct{}, bool) {
+	return n.s.LockLost(n.prefix + key)
+}
+
+func (n *LockNamespace) Fence(key string) (int64, bool) {
+	return n.s.Fence(n.prefix + key)
+}
+
+// LockInfo describes the lock on key. The key of the result is relative to
+// the namespace.
+func (n *LockNamespace) LockInfo(key string) (*LockInfo, error) {
+	info, err := n.s.LockInfo(n.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+	info.Key = key
+	return info, nil
+}
+
+// ListLocks lists the locks on keys starting with prefix. The keys of the
+// results are relative to the namespace.
+func (n *LockNamespace) ListLocks(prefix string) ([]*LockInfo, error) {
+	infos, err := n.s.ListLocks(n.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		info.Key = strings.TrimPrefix(info.Key, n.prefix)
+	}
+	return infos, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*LockApp)(nil)
+	_ caddy.Provisioner  = (*LockApp)(nil)
+	_ caddy.CleanerUpper = (*LockApp)(nil)
+)
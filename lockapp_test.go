@@ -0,0 +1,44 @@
+package storagefirestore
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLockApp_config(t *testing.T) {
+	app := (&LockApp{}).CaddyModule().New().(*LockApp)
+	assert.NoError(t, json.Unmarshal([]byte(`{"storage": {"project_id": "app-project"}}`), app))
+
+	assert.Equal(t, "app-project", app.Storage.ProjectId)
+	assert.Equal(t, DefaultAppLockCollection, app.Storage.LockCollection)
+	assert.Equal(t, DefaultFreshnessIntervalSeconds, app.Storage.FreshnessSeconds)
+}
+
+func TestLockApp_Namespace(t *testing.T) {
+	app := &LockApp{Storage: New()}
+
+	ns, err := app.Namespace("cron")
+	assert.NoError(t, err)
+	assert.Equal(t, "cron", ns.Name())
+	assert.Equal(t, "cron/", ns.prefix)
+
+	_, err = app.Namespace("")
+	assert.Error(t, err)
+	_, err = app.Namespace("a/b")
+	assert.Error(t, err)
+	_, err = app.Namespace(electionNamespace)
+	assert.Error(t, err)
+}
+
+func TestLockApp_NamespaceCollision(t *testing.T) {
+	app := &LockApp{Storage: New()}
+
+	// Key "b/x" of namespace "a" and key "x" of namespace "a\b" would
+	// share a document.
+	a, err := app.Namespace("a")
+	assert.NoError(t, err)
+	assert.Equal(t, firestoreSafeKey(`a\b`+"/x"), firestoreSafeKey(a.prefix+"b/x"))
+	_, err = app.Namespace(`a\b`)
+	assert.Error(t, err)
+}
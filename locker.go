@@ -5,167 +5,568 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
-var errAlreadyLocked = errors.New("certificate is already locked")
+// How long to wait before retrying a failed lock refresh.
+const refreshRetryInterval = time.Second
+
+// How long Cleanup waits for held locks to be unlocked.
+const shutdownTimeout = 10 * time.Second
+
+var (
+	errAlreadyLocked = errors.New("certificate is already locked")
+	errLockNotOwned  = errors.New("lock is held by another owner")
+)
+
+// ErrLocked is returned when a lock is held by someone else.
+//
+// It unwraps to errAlreadyLocked.
+type ErrLocked struct {
+	Key string
+
+	// Owner ID of the current holder (see LockRecord).
+	Holder string
+
+	// How long the current holder has had the lock.
+	Age time.Duration
+}
+
+func (e *ErrLocked) Error() string {
+	return fmt.Sprintf("%s is locked by %s (held for %s)", e.Key, e.Holder, e.Age)
+}
+
+func (e *ErrLocked) Unwrap() error {
+	return errAlreadyLocked
+}
+
+// LockRecord is the document stored in the lock collection for each held lock.
+//
+// Lock state lives apart from the certificate data so that refreshing a
+// lock never rewrites (or contends with) the certificate document.
+// ExpiresAt is meant for a Firestore TTL policy on the lock collection,
+// which lets abandoned lock documents clean themselves up.
+//
+// Owner and Hostname identify the Storage instance holding the lock. Token is
+// sampled fresh on every acquisition; refreshes and unlocks only go through
+// when it still matches, so a holder whose lock went stale and was taken over
+// cannot clobber or release the new holder's lock.
+//
+// Fence is the fencing number of the acquisition (see fence.go), which is
+// also kept in a counter document below the lock document. Unlocking only
+// marks the document as Released; the TTL policy removes it later. Locks
+// released by ForceUnlock also record who forced them and why.
+type LockRecord struct {
+	Owner       string    `firestore:"owner"`
+	Hostname    string    `firestore:"hostname"`
+	Token       string    `firestore:"token"`
+	LockedAt    time.Time `firestore:"lockedAt"`
+	RefreshedAt time.Time `firestore:"refreshedAt"`
+	ExpiresAt   time.Time `firestore:"expiresAt"`
+	Fence       int64     `firestore:"fence"`
+	Released    bool      `firestore:"released"`
+
+	ForcedBy     string    `firestore:"forcedBy,omitempty"`
+	ForcedReason string    `firestore:"forcedReason,omitempty"`
+	ForcedAt     time.Time `firestore:"forcedAt,omitempty"`
+
+	// Set when the holder's MaxLockHoldSeconds limits the lock (see lease.go).
+	LeaseUntil time.Time `firestore:"leaseUntil"`
+
+	// The last ticket handed out in queue mode.
+	NextTicket int64 `firestore:"nextTicket"`
+}
 
 // Lock acquires a distributed lock for the given key or blocks until it gets one.
+//
+// While waiting, a snapshot listener on the lock document retries as soon as
+// the lock is released or goes stale. If the listener fails, Lock falls back
+// to polling with the configured LockBackoff.
+//
+// Goroutines of this process queue up locally behind the one holding the lock,
+// so only one of them ever holds (and refreshes) the remote lock.
 func (s *Storage) Lock(ctx context.Context, key string) error {
-	for {
-		err := s.attemptLock(ctx, key)
+	_, err := s.lock(ctx, key)
+	return err
+}
+
+// TryLock attempts to acquire the lock for key without blocking.
+//
+// It returns false and an *ErrLocked if the lock is held, by this process
+// or another one.
+func (s *Storage) TryLock(ctx context.Context, key string) (bool, error) {
+	hold, ok := s.tryAcquireLocal(key)
+	if !ok {
+		return false, s.localHolder(key)
+	}
+
+	if err := s.attemptLockWithTicket(ctx, key, nil, hold); err != nil {
+		s.releaseLocal(key, hold)
+		return false, err
+	}
+	return true, nil
+}
+
+// LockWithTimeout is like Lock, but gives up after timeout.
+//
+// The timeout only bounds acquiring the lock, which is then held and
+// refreshed until Unlock. On timeout, it returns an *ErrLocked describing
+// the holder it last saw.
+func (s *Storage) LockWithTimeout(ctx context.Context, key string, timeout time.Duration) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	lastLocked, err := s.lock(timeoutCtx, key)
+	if err != nil && ctx.Err() == nil && timeoutCtx.Err() == context.DeadlineExceeded && lastLocked != nil {
+		return lastLocked
+	}
+	return err
+}
+
+// lock implements Lock. It also returns the last *ErrLocked seen while waiting.
+func (s *Storage) lock(ctx context.Context, key string) (lastLocked *ErrLocked, err error) {
+	hold, err := s.acquireLocal(ctx, key)
+	if err != nil {
+		return s.localHolder(key), err
+	}
+	defer func() {
+		if err != nil {
+			s.releaseLocal(key, hold)
+		}
+	}()
+
+	var watch *lockWatch
+	defer func() {
+		if watch != nil {
+			watch.stop()
+		}
+	}()
+
+	var ticket *LockTicket
+	defer func() {
+		if ticket != nil {
+			s.leaveQueue(key, ticket, err == nil)
+		}
+	}()
+
+	backoff := s.newBackoff()
+	for attempts := 1; ; attempts++ {
+		err := s.attemptLockWithTicket(ctx, key, ticket, hold)
 
 		if err == nil {
+			lockMetrics.attempts.Observe(float64(attempts))
 			// TODO: go func for context cancel?
-			return nil
+			return nil, nil
 		}
 
-		if err != errAlreadyLocked {
-			return err
+		if !errors.As(err, &lastLocked) {
+			return lastLocked, err
+		}
+		backoff.observe(lastLocked.Holder)
+
+		if s.LockQueue && ticket == nil {
+			// Only queue up once the lock turned out to be contended.
+			if ticket, err = s.joinQueue(ctx, key); err != nil {
+				return lastLocked, err
+			}
+		}
+
+		if watch == nil {
+			watch = s.watchLock(ctx, key)
 		}
 
-		if didAbort := s.sleepOrAbort(ctx, s.randSleepTime()); didAbort {
-			return ctx.Err() // Pattern used by certmagic/filestorage.go
+		if didAbort := s.waitForLock(ctx, watch, backoff); didAbort {
+			return lastLocked, ctx.Err() // Pattern used by certmagic/filestorage.go
 		}
 	}
 }
 
+// waitForLock blocks until the lock may be free to acquire.
+//
+// The listener is trusted to report releases and staleness, but a retry
+// still happens after one stale interval as a safety net. Without a
+// listener, attempts are spaced out by backoff.
+func (s *Storage) waitForLock(ctx context.Context, watch *lockWatch, backoff *lockBackoff) (didAbort bool) {
+	select {
+	case <-watch.failed:
+		return s.sleepOrAbort(ctx, backoff.next())
+	default:
+	}
+
+	timer := time.NewTimer(s.staleAfter())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return true
+	case <-watch.C:
+		return false
+	case <-watch.failed:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
 
 func (s *Storage) Unlock(key string) error {
+	return s.unlock(context.Background(), key)
+}
+
+func (s *Storage) unlock(ctx context.Context, key string) error {
 	// According to certmagic, Unlock is called after log, even in
 	// case of error or timeout of critical section.
-	if found := s.unlockLocal(key); !found {
+	held, found := s.unlockLocal(key)
+	if !found {
 		return fmt.Errorf("lock %s was not found", key)
 	}
+	defer s.releaseLocal(key, held.localHold)
 
-	// TODO: add nonce and only update if matched?
-	_, err := s.keyToRef(key).Update(context.Background(), []firestore.Update{
-		{Path: "locked", Value: false},
-		{Path: "lockedAt", Value: UTCNow()},
+	err := s.updateOwnedLock(ctx, key, held.token, func(t *firestore.Transaction, doc *firestore.DocumentSnapshot) error {
+		return t.Update(doc.Ref, []firestore.Update{
+			{Path: "released", Value: true},
+		})
 	})
 
 	if err != nil {
 		return fmt.Errorf("unable to unlock %s: %w", key, err)
 	}
 
-
 	return nil
 }
 
+// unlockAll unlocks every lock this instance holds, e.g. on shutdown.
+// Holders are told they lost their locks (see LockLost); their own later
+// Unlock calls fail.
+func (s *Storage) unlockAll(ctx context.Context) {
+	s.m.Lock()
+	keys := make([]string, 0, len(s.locks))
+	for key := range s.locks {
+		keys = append(keys, key)
+	}
+	s.m.Unlock()
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := s.unlock(ctx, key); err != nil {
+				s.logger.Warnf("unable to release lock on shutdown: %v", err)
+				return
+			}
+			s.logger.Infof("released lock %s on shutdown", key)
+		}(key)
+	}
+	wg.Wait()
+}
+
 // attemptLock executes a transaction to acquire a lock on a particular key.
 //
-// It does this by setting the `locked` and `lockedAt` fields of the particular
-// document in firestore in a transaction.
+// It does this by creating (or taking over a released or stale) document for
+// the key in the lock collection in a transaction. Each acquisition gets the
+// next fencing number for the key.
 //
-// It does not block on errAlreadyLocked failure.
+// In queue mode, it only succeeds if nobody is queued for the key.
+//
+// It does not block on *ErrLocked failure.
 func (s *Storage) attemptLock(ctx context.Context, key string) error {
+	return s.attemptLockWithTicket(ctx, key, nil, 0)
+}
+
+// attemptLockWithTicket is attemptLock for a waiter holding ticket in the
+// queue of key (see lockqueue.go), which only succeeds on its turn, and
+// holding key locally with hold (see acquireLocal).
+func (s *Storage) attemptLockWithTicket(ctx context.Context, key string, ticket *LockTicket, hold uint64) error {
 	if s.hasLockLocal(key) {
-		return nil  // We already locally have the lock
+		// Another goroutine of this process holds it. Lock queues on
+		// acquireLocal, so this only happens when called directly.
+		return s.localHolder(key)
 	}
 
-	ref := s.keyToRef(key)
-	err := s.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	var fence int64
+	var notOurTurn *ErrLocked
+	ref := s.lockRef(key)
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		notOurTurn = nil
+
 		doc, err := t.Get(ref)
 
-		if err != nil {
-			if IsDocNotFound(err) {
-				// No document yet exists for the key. Create it with the
-				// lock already set.
-				now := UTCNow()
-				return t.Create(ref, &Record{
-					Locked:    true,
-					LockedAt:  now,
-					CreatedAt: now,
-					UpdatedAt: now,
-				})
-			} else {
+		if err != nil && !IsDocNotFound(err) {
+			return err
+		}
+
+		// All lock times are server times. ReadTime is set even if the
+		// document does not exist.
+		now := doc.ReadTime
+		s.observeServerTime(now)
+
+		var lock LockRecord
+		if err == nil {
+			// A lock document already exists.
+			if err := doc.DataTo(&lock); err != nil {
 				return err
 			}
+
+			if !lock.Released && !s.isExpired(&lock, now) {
+				// valid lock found; poll again soon.
+				// otherwise, overwrite it.
+				return &ErrLocked{Key: key, Holder: lock.Owner, Age: now.Sub(lock.LockedAt)}
+			}
 		}
 
-		// The document does already exist.
+		// The lock is free. In queue mode, it goes to the oldest live ticket.
+		var reap []*firestore.DocumentRef
+		if s.LockQueue {
+			var head *LockTicket
+			head, reap, err = s.queueHead(t, key, now)
+			if err != nil {
+				return err
+			}
 
-		// Read it
-		var cert Record
-		err = doc.DataTo(&cert)
-		if err != nil {
-			return err
+			if head != nil && (ticket == nil || head.Seq != ticket.Seq) {
+				notOurTurn = &ErrLocked{Key: key, Holder: head.Owner}
+			}
 		}
 
-		if cert.Locked && !s.isStale(cert.LockedAt) {
-			// valid lock found; poll again soon.
-			// otherwise, overwrite it.
-			return errAlreadyLocked
+		if notOurTurn == nil {
+			fence, err = s.nextFence(t, key, lock.Fence)
+			if err != nil {
+				return err
+			}
 		}
 
-		return t.Update(ref, []firestore.Update{
-			{Path: "locked", Value: true},
-			{Path: "lockedAt", Value: UTCNow()},
-		})
+		// Reads are done from here on.
+
+		// Reap stale tickets even if it isn't our turn, so the queue can't
+		// get stuck behind dead waiters.
+		for _, stale := range reap {
+			if err := t.Delete(stale); err != nil {
+				return err
+			}
+		}
+
+		if notOurTurn != nil {
+			return nil
+		}
+
+		if ticket != nil {
+			if err := t.Delete(s.ticketRef(key, ticket.Seq)); err != nil {
+				return err
+			}
+		}
+
+		if err := s.setFence(t, key, fence); err != nil {
+			return err
+		}
+
+		record := map[string]interface{}{
+			"owner":       s.owner,
+			"hostname":    s.hostname,
+			"token":       token,
+			"lockedAt":    firestore.ServerTimestamp,
+			"refreshedAt": firestore.ServerTimestamp,
+			"expiresAt":   s.expiresAt(now),
+			"fence":       fence,
+			"released":    false,
+			"nextTicket":  lock.NextTicket,
+		}
+		if maxHold := s.maxHold(); maxHold > 0 {
+			record["leaseUntil"] = now.Add(maxHold)
+		}
+		return t.Set(ref, record)
 	})
 
 	if err != nil {
-		if err == errAlreadyLocked {
+		if errors.Is(err, errAlreadyLocked) {
 			return err
 		}
 		return fmt.Errorf("unable to lock %s: %w", key, err)
 	}
 
-	go s.keepLockFresh(s.lockLocal(ctx, key), key)
+	if notOurTurn != nil {
+		return notOurTurn
+	}
+
+	held := newHeldLock(token, fence)
+	held.localHold = hold
+	go s.keepLockFresh(s.lockLocal(key, held), key, held)
 
 	return nil
 }
 
-// keepLockFresh maintains lockedAt to prevent active lock expiration
+// keepLockFresh maintains refreshedAt to prevent active lock expiration
 //
 // > To prevent deadlocks, all implementations should put a reasonable
 // > expiration on the lock in case Unlock is unable to be called
 // > due to some sort of network failure or system crash.
-func (s *Storage) keepLockFresh(ctx context.Context, key string) {
+//
+// Failed refreshes are retried until the lock would have gone stale. If
+// the lock is taken over, goes stale or runs out its lease, it is marked
+// lost (see LockLost).
+func (s *Storage) keepLockFresh(ctx context.Context, key string, held *heldLock) {
 	interval := time.Duration(s.FreshnessSeconds) * time.Second
 	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	// The lease started on the server a little before acquiredAt, so the
+	// rest of the cluster may consider the lock expired slightly earlier.
+	// Fencing rejects writes in between.
+	var leaseEnd <-chan time.Time
+	if maxHold := s.maxHold(); maxHold > 0 {
+		lease := time.NewTimer(maxHold - time.Since(held.acquiredAt))
+		defer lease.Stop()
+		leaseEnd = lease.C
+	}
 
+	refreshedAt := time.Now()
 	for {
 		select {
 		case <-timer.C:
-			err := s.updateFreshness(ctx, key)
-			if err != nil {
-				// TODO: log
-				return
-			}
-			timer.Reset(interval)
+		case <-leaseEnd:
+			s.loseLock(key, held, errLeaseExpired)
+			return
 		case <-ctx.Done():
 			// Lock relinquished.
-			if !timer.Stop() {
-				<- timer.C
-			}
 			return
 		}
+
+		s.checkLongHold(key, held)
+
+		err := s.updateFreshness(ctx, key, held.token)
+		switch {
+		case err == nil:
+			refreshedAt = time.Now()
+			timer.Reset(interval)
+		case ctx.Err() != nil:
+			// Relinquished while refreshing.
+			return
+		case errors.Is(err, errLockNotOwned), errors.Is(err, errLeaseExpired):
+			s.loseLock(key, held, err)
+			return
+		default:
+			lockMetrics.refreshFailures.Inc()
+			if time.Since(refreshedAt) >= s.staleAfter() {
+				s.loseLock(key, held, err)
+				return
+			}
+			s.logger.Warnf("unable to refresh lock %s, retrying: %v", key, err)
+			timer.Reset(refreshRetryInterval)
+		}
+	}
+}
+
+// loseLock signals the holder of key that its lock is gone.
+func (s *Storage) loseLock(key string, held *heldLock, cause error) {
+	lockMetrics.lost.Inc()
+	s.logger.Errorf("lost lock %s: %v", key, cause)
+	held.markLost()
+}
+
+// LockLost returns a channel that is closed if the lock this instance holds
+// on key is lost, e.g. because it could not be refreshed and went stale or
+// was taken over by another node. Holders should abort their work once it
+// closes. The second result is false if the lock isn't held.
+func (s *Storage) LockLost(key string) (<-chan struct{}, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if held, found := s.locks[key]; found {
+		return held.lost.Done(), true
 	}
+	return nil, false
 }
 
-func (s *Storage) updateFreshness(ctx context.Context, key string) error {
-	ref := s.keyToRef(key)
+func (s *Storage) updateFreshness(ctx context.Context, key, token string) error {
+	return s.updateOwnedLock(ctx, key, token, func(t *firestore.Transaction, doc *firestore.DocumentSnapshot) error {
+		s.observeServerTime(doc.ReadTime)
+
+		var lock LockRecord
+		if err := doc.DataTo(&lock); err != nil {
+			return err
+		}
+		if lock.leaseExpired(doc.ReadTime) {
+			return errLeaseExpired
+		}
 
-	_, err := ref.Update(ctx, []firestore.Update{
-		{Path: "lockedAt", Value: UTCNow()},
+		return t.Update(doc.Ref, []firestore.Update{
+			{Path: "refreshedAt", Value: firestore.ServerTimestamp},
+			{Path: "expiresAt", Value: s.expiresAt(doc.ReadTime)},
+		})
 	})
+}
 
-	return err
+// updateOwnedLock runs update in a transaction, but only if the lock for key
+// is still held with token. Otherwise, it returns errLockNotOwned.
+func (s *Storage) updateOwnedLock(ctx context.Context, key, token string, update func(*firestore.Transaction, *firestore.DocumentSnapshot) error) error {
+	ref := s.lockRef(key)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		doc, err := t.Get(ref)
+		if err != nil {
+			if IsDocNotFound(err) {
+				return errLockNotOwned
+			}
+			return err
+		}
+
+		var lock LockRecord
+		if err := doc.DataTo(&lock); err != nil {
+			return err
+		}
+
+		if lock.Released || lock.Token != token {
+			return errLockNotOwned
+		}
+
+		return update(t, doc)
+	})
+}
+
+// loadLock reads the lock document for key.
+func (s *Storage) loadLock(ctx context.Context, key string) (*LockRecord, error) {
+	doc, err := s.lockRef(key).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock LockRecord
+	if err := doc.DataTo(&lock); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// isStale reports whether a lock refreshed at mTime is stale at now.
+//
+// Both times must come from the Firestore server (see clock.go).
+func (s *Storage) isStale(mTime, now time.Time) bool {
+	return now.After(s.expiresAt(mTime))
+}
+
+// expiresAt is when a lock refreshed at mTime goes stale.
+func (s *Storage) expiresAt(mTime time.Time) time.Time {
+	return mTime.Add(s.staleAfter())
 }
 
-func (s *Storage) isStale(mTime time.Time) bool {
+// staleAfter is how long a lock stays valid without a refresh.
+func (s *Storage) staleAfter() time.Duration {
 	// Twice the freshness seconds to allow a latency grace period.
-	staleTime := mTime.Add(time.Second * time.Duration(s.FreshnessSeconds) * 2)
-	return UTCNow().After(staleTime)
+	return time.Second * time.Duration(s.FreshnessSeconds) * 2
 }
 
 func (s *Storage) keyToRef(key string) *firestore.DocumentRef {
 	return s.client.Collection(s.Collection).Doc(firestoreSafeKey(key))
 }
 
+func (s *Storage) lockRef(key string) *firestore.DocumentRef {
+	return s.client.Collection(s.LockCollection).Doc(firestoreSafeKey(key))
+}
+
 func firestoreSafeKey(key string) string {
 	// Keys are forward slash separated with no leading slash.
 	// This doesn't work with firebase since paths are forward
@@ -173,13 +574,18 @@ func firestoreSafeKey(key string) string {
 	return strings.ReplaceAll(key, "/", "\\")
 }
 
+// keyFromSafe reverses firestoreSafeKey.
+func keyFromSafe(id string) string {
+	return strings.ReplaceAll(id, "\\", "/")
+}
+
 func (s *Storage) sleepOrAbort(ctx context.Context, duration time.Duration) (didAbort bool) {
 	timer := time.NewTimer(duration)
 
 	select {
 	case <-ctx.Done():
 		if !timer.Stop() {
-			<-timer.C  // Drain
+			<-timer.C // Drain
 		}
 		return true
 	case <-timer.C:
@@ -187,12 +593,6 @@ func (s *Storage) sleepOrAbort(ctx context.Context, duration time.Duration) (did
 	}
 }
 
-func (s *Storage) randSleepTime() time.Duration {
-	delta := float64(s.MaxPollSeconds - s.MinPollSeconds)
-	randTime := time.Microsecond * time.Duration(delta * rand.Float64() * float64(time.Millisecond))
-	return time.Second * time.Duration(s.MinPollSeconds) + randTime
-}
-
 func (s *Storage) hasLockLocal(key string) bool {
 	s.m.Lock()
 	defer s.m.Unlock()
@@ -200,23 +600,144 @@ func (s *Storage) hasLockLocal(key string) bool {
 	return found
 }
 
-func (s *Storage) lockLocal(parent context.Context, key string) context.Context {
+// lockLocal records held as the lock on key and returns the context its
+// refresher runs in. It outlives the context the lock was acquired with,
+// which may only bound the acquisition (see LockWithTimeout), and is done
+// once unlocked.
+func (s *Storage) lockLocal(key string, held *heldLock) context.Context {
 	s.m.Lock()
-	withCancel, cancel := context.WithCancel(parent)
-	s.locks[key] = cancel
+	withCancel, cancel := context.WithCancel(context.Background())
+	held.cancel = cancel
+	s.locks[key] = held
 	s.m.Unlock()
 
 	return withCancel
 }
 
-func (s *Storage) unlockLocal(key string) bool {
+// unlockLocal drops the local state for key and returns it.
+func (s *Storage) unlockLocal(key string) (*heldLock, bool) {
 	s.m.Lock()
 	defer s.m.Unlock()
-	if cancel, found := s.locks[key]; found {
-		cancel()
+	if held, found := s.locks[key]; found {
+		held.cancel()
+		held.markLost()
+		if held.longHeld {
+			lockMetrics.longHeld.Dec()
+		}
 		delete(s.locks, key)
-		return true
+		return held, true
+	}
+	return nil, false
+}
+
+// localLock queues the goroutines of this process that want the same key.
+type localLock struct {
+	// Holds a value while the key is held locally.
+	held chan struct{}
+
+	// When the current holder got the key, and its hold number (zero
+	// when free). Guarded by Storage.m.
+	heldSince time.Time
+	hold      uint64
+
+	// Goroutines holding or waiting on the key. Guarded by Storage.m.
+	refs int
+}
+
+// acquireLocal blocks until no other goroutine of this process holds key,
+// or until ctx is done. It returns the number of the hold, to release it
+// with.
+func (s *Storage) acquireLocal(ctx context.Context, key string) (uint64, error) {
+	l := s.refLocal(key)
+
+	select {
+	case l.held <- struct{}{}:
+		return s.heldLocal(l), nil
+	case <-ctx.Done():
+		s.m.Lock()
+		s.derefLocal(key, l)
+		s.m.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// tryAcquireLocal is acquireLocal without waiting. It reports whether
+// key was acquired.
+func (s *Storage) tryAcquireLocal(key string) (uint64, bool) {
+	l := s.refLocal(key)
+
+	select {
+	case l.held <- struct{}{}:
+		return s.heldLocal(l), true
+	default:
+		s.m.Lock()
+		s.derefLocal(key, l)
+		s.m.Unlock()
+		return 0, false
+	}
+}
+
+// refLocal returns the queue for key, counting the caller in.
+func (s *Storage) refLocal(key string) *localLock {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.localLocks == nil {
+		s.localLocks = map[string]*localLock{}
+	}
+	l, found := s.localLocks[key]
+	if !found {
+		l = &localLock{held: make(chan struct{}, 1)}
+		s.localLocks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (s *Storage) heldLocal(l *localLock) uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.localHolds++
+	l.heldSince = time.Now()
+	l.hold = s.localHolds
+	return l.hold
+}
+
+// localHolder describes the goroutine of this process holding key.
+func (s *Storage) localHolder(key string) *ErrLocked {
+	s.m.Lock()
+	defer s.m.Unlock()
+	locked := &ErrLocked{Key: key, Holder: s.owner}
+	if l, found := s.localLocks[key]; found && !l.heldSince.IsZero() {
+		locked.Age = time.Since(l.heldSince)
+	}
+	return locked
+}
+
+// releaseLocal lets the next queued goroutine, if any, have key. It does
+// nothing unless key is still held with hold, so a stray release can't
+// free a hold it doesn't own.
+func (s *Storage) releaseLocal(key string, hold uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	l, found := s.localLocks[key]
+	if !found || hold == 0 || l.hold != hold {
+		return
 	}
-	return false
+	l.hold = 0
+	l.heldSince = time.Time{}
+
+	// The hold filled l.held, so this doesn't block.
+	select {
+	case <-l.held:
+	default:
+	}
+	s.derefLocal(key, l)
 }
 
+// derefLocal forgets l once nobody holds or waits on it. Requires s.m.
+func (s *Storage) derefLocal(key string, l *localLock) {
+	l.refs--
+	if l.refs == 0 {
+		delete(s.localLocks, key)
+	}
+}
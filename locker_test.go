@@ -2,32 +2,15 @@ package storagefirestore
 
 import (
 	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"sync"
 	"testing"
 	"time"
 )
 
-func TestStorage_randSleepTime(t *testing.T) {
-	s := Storage{
-		MinPollSeconds: 10,
-		MaxPollSeconds: 20,
-	}
-
-	min := time.Second * time.Duration(s.MinPollSeconds)
-	max := time.Second * time.Duration(s.MaxPollSeconds)
-
-	n := 100
-	samples := map[time.Duration]bool{}
-	for i := 0; i < n; i++ {
-		x := s.randSleepTime()
-		assert.Less(t, float64(x), float64(max))
-		assert.GreaterOrEqual(t, float64(x), float64(min))
-		samples[x] = true
-	}
-
-	assert.Len(t, samples, n)
-}
-
 func TestStorage_sleepOrAbort(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -44,8 +27,198 @@ func TestStorage_sleepOrAbort(t *testing.T) {
 
 func TestStorage_isStale(t *testing.T) {
 	s := Storage{FreshnessSeconds: 60}
-	assert.False(t, s.isStale(UTCNow().Add(-30 * time.Second)))
-	assert.False(t, s.isStale(UTCNow().Add(-60 * time.Second)))
-	assert.False(t, s.isStale(UTCNow().Add(-120 * time.Second)))
-	assert.True(t, s.isStale(UTCNow().Add(-121 * time.Second)))
-}
\ No newline at end of file
+	now := UTCNow()
+	assert.False(t, s.isStale(now.Add(-30*time.Second), now))
+	assert.False(t, s.isStale(now.Add(-60*time.Second), now))
+	assert.False(t, s.isStale(now.Add(-120*time.Second), now))
+	assert.True(t, s.isStale(now.Add(-121*time.Second), now))
+
+	// Only the given times matter, not the local clock.
+	skewed := now.Add(time.Hour)
+	assert.False(t, s.isStale(skewed.Add(-120*time.Second), skewed))
+	assert.True(t, s.isStale(now, skewed))
+}
+
+func TestStorage_waitForLock(t *testing.T) {
+	s := Storage{MinPollSeconds: 0, MaxPollSeconds: 0, FreshnessSeconds: 60}
+
+	c := make(chan struct{}, 1)
+	failed := make(chan struct{})
+	watch := &lockWatch{C: c, failed: failed, stop: func() {}}
+
+	// A notification wakes the waiter.
+	c <- struct{}{}
+	assert.False(t, s.waitForLock(context.Background(), watch, s.newBackoff()))
+
+	// Cancellation aborts.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.True(t, s.waitForLock(ctx, watch, s.newBackoff()))
+
+	// A failed listener falls back to polling.
+	close(failed)
+	start := time.Now()
+	assert.False(t, s.waitForLock(context.Background(), watch, s.newBackoff()))
+	assert.Less(t, float64(time.Since(start)), float64(time.Second))
+}
+
+func TestUntilStale(t *testing.T) {
+	now := UTCNow()
+	assert.Equal(t, time.Duration(0), untilStale(now.Add(-time.Minute), now))
+	assert.Equal(t, time.Second+100*time.Millisecond, untilStale(now.Add(time.Second), now))
+}
+
+func TestStorage_acquireLocal(t *testing.T) {
+	s := New()
+	key := "exclusive"
+
+	// Goroutines must take turns; the race detector flags any overlap
+	// on inside/entered.
+	inside := 0
+	entered := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hold, err := s.acquireLocal(context.Background(), key)
+			assert.NoError(t, err)
+			inside++
+			entered++
+			assert.Equal(t, 1, inside)
+			time.Sleep(time.Millisecond)
+			inside--
+			s.releaseLocal(key, hold)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8, entered)
+	assert.Empty(t, s.localLocks)
+}
+
+func TestStorage_acquireLocalCancel(t *testing.T) {
+	s := New()
+	key := "exclusive"
+
+	hold, err := s.acquireLocal(context.Background(), key)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.acquireLocal(ctx, key)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, s.localLocks[key].refs)
+
+	s.releaseLocal(key, hold)
+	assert.Empty(t, s.localLocks)
+
+	// Released keys can be acquired again.
+	hold, err = s.acquireLocal(context.Background(), key)
+	assert.NoError(t, err)
+	s.releaseLocal(key, hold)
+}
+
+func TestStorage_LockLost(t *testing.T) {
+	s := New()
+	s.logger = zap.NewNop().Sugar()
+	key := "lost"
+
+	_, found := s.LockLost(key)
+	assert.False(t, found)
+
+	held := newHeldLock("token", 1)
+	s.lockLocal(key, held)
+	lost, found := s.LockLost(key)
+	assert.True(t, found)
+
+	before := testutil.ToFloat64(lockMetrics.lost)
+	s.loseLock(key, held, errLockNotOwned)
+	assert.Equal(t, before+1, testutil.ToFloat64(lockMetrics.lost))
+
+	select {
+	case <-lost:
+	default:
+		assert.Fail(t, "lock loss was not signaled")
+	}
+
+	// Releasing locally also closes it.
+	held = newHeldLock("token", 2)
+	s.lockLocal(key, held)
+	lost, _ = s.LockLost(key)
+	_, found = s.unlockLocal(key)
+	assert.True(t, found)
+	<-lost
+}
+
+func TestStorage_TryLockLocal(t *testing.T) {
+	s := New()
+	s.owner = "local-owner"
+	key := "try"
+
+	// Another goroutine of this process holds the key.
+	hold, err := s.acquireLocal(context.Background(), key)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+
+	ok, err := s.TryLock(context.Background(), key)
+	assert.False(t, ok)
+	var locked *ErrLocked
+	assert.True(t, errors.As(err, &locked))
+	assert.True(t, errors.Is(err, errAlreadyLocked))
+	assert.Equal(t, key, locked.Key)
+	assert.Equal(t, "local-owner", locked.Holder)
+	assert.True(t, locked.Age > 0)
+
+	err = s.LockWithTimeout(context.Background(), key, 10*time.Millisecond)
+	assert.True(t, errors.As(err, &locked))
+	assert.Equal(t, "local-owner", locked.Holder)
+
+	// Cancellation by the caller is not a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.LockWithTimeout(ctx, key, time.Second))
+
+	s.releaseLocal(key, hold)
+	assert.Empty(t, s.localLocks)
+}
+
+func TestStorage_releaseLocalStray(t *testing.T) {
+	s := New()
+	key := "stray"
+
+	// Releasing what isn't held neither blocks nor frees anything.
+	s.releaseLocal(key, 0)
+	s.releaseLocal(key, 42)
+
+	hold, err := s.acquireLocal(context.Background(), key)
+	assert.NoError(t, err)
+	waiting := make(chan uint64)
+	go func() {
+		next, _ := s.acquireLocal(context.Background(), key)
+		waiting <- next
+	}()
+
+	// A stray release, like an Unlock of a lock taken with attemptLock,
+	// doesn't let the waiter in.
+	s.releaseLocal(key, 0)
+	s.releaseLocal(key, hold+1)
+	select {
+	case <-waiting:
+		assert.Fail(t, "stray release freed the key")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	s.releaseLocal(key, hold)
+	next := <-waiting
+	assert.NotEqual(t, hold, next)
+
+	// Releasing twice only counts once.
+	s.releaseLocal(key, hold)
+	assert.Equal(t, 1, s.localLocks[key].refs)
+	s.releaseLocal(key, next)
+	assert.Empty(t, s.localLocks)
+}
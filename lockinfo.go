@@ -0,0 +1,118 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/certmagic"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrLockNotFound is returned (wrapped in certmagic.ErrNotExist) when a key
+// isn't locked.
+var ErrLockNotFound = errors.New("lock not found")
+
+// LockInfo describes a lock for introspection.
+type LockInfo struct {
+	Key string `json:"key"`
+
+	// Owner ID and hostname of the holder.
+	Holder   string `json:"holder"`
+	Hostname string `json:"hostname"`
+
+	AcquiredAt  time.Time `json:"acquired_at"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	Fence       int64     `json:"fence"`
+
+	// When the lock expires regardless of refreshes, if it is limited.
+	LeaseUntil *time.Time `json:"lease_until,omitempty"`
+
+	// Stale locks, including those past their lease, are free for anyone
+	// to take over.
+	Stale bool `json:"stale"`
+}
+
+// LockInfo returns the current lock on key.
+//
+// It returns ErrLockNotFound if the key isn't locked.
+func (s *Storage) LockInfo(key string) (*LockInfo, error) {
+	var doc *firestore.DocumentSnapshot
+	err := s.breaker.guard(func() (err error) {
+		doc, err = s.lockRef(key).Get(context.Background())
+		return err
+	})
+	if err != nil {
+		if IsDocNotFound(err) {
+			return nil, certmagic.ErrNotExist(fmt.Errorf("%w: %s", ErrLockNotFound, key))
+		}
+		return nil, err
+	}
+
+	var lock LockRecord
+	if err := doc.DataTo(&lock); err != nil {
+		return nil, err
+	}
+
+	if lock.Released {
+		return nil, certmagic.ErrNotExist(fmt.Errorf("%w: %s", ErrLockNotFound, key))
+	}
+
+	return s.lockInfo(key, &lock, doc.ReadTime), nil
+}
+
+// ListLocks returns the locks on keys starting with prefix, sorted by key.
+// Released locks are left out.
+func (s *Storage) ListLocks(prefix string) ([]*LockInfo, error) {
+	// TODO: add timeout
+	var snapshots []*firestore.DocumentSnapshot
+	err := s.breaker.guard(func() (err error) {
+		snapshots, err = s.client.Collection(s.LockCollection).Documents(context.Background()).GetAll()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []*LockInfo{}
+	translatedPrefix := firestoreSafeKey(prefix)
+	for _, snapshot := range snapshots {
+		if !strings.HasPrefix(snapshot.Ref.ID, translatedPrefix) {
+			continue
+		}
+
+		var lock LockRecord
+		if err := snapshot.DataTo(&lock); err != nil {
+			return nil, err
+		}
+
+		if !lock.Released {
+			infos = append(infos, s.lockInfo(keyFromSafe(snapshot.Ref.ID), &lock, snapshot.ReadTime))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key < infos[j].Key
+	})
+	return infos, nil
+}
+
+// lockInfo converts a lock record read at the server time now.
+func (s *Storage) lockInfo(key string, lock *LockRecord, now time.Time) *LockInfo {
+	info := &LockInfo{
+		Key:         key,
+		Holder:      lock.Owner,
+		Hostname:    lock.Hostname,
+		AcquiredAt:  lock.LockedAt,
+		RefreshedAt: lock.RefreshedAt,
+		Fence:       lock.Fence,
+		Stale:       s.isExpired(lock, now),
+	}
+	if !lock.LeaseUntil.IsZero() {
+		leaseUntil := lock.LeaseUntil
+		info.LeaseUntil = &leaseUntil
+	}
+	return info
+}
@@ -0,0 +1,40 @@
+package storagefirestore
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestStorage_lockInfo(t *testing.T) {
+	s := New()
+	now := UTCNow()
+	lock := &LockRecord{Owner: "owner", LockedAt: now, RefreshedAt: now}
+
+	b, err := json.Marshal(s.lockInfo("key", lock, now))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "lease_until")
+
+	lock.LeaseUntil = now.Add(time.Minute)
+	info := s.lockInfo("key", lock, now)
+	assert.Equal(t, lock.LeaseUntil, *info.LeaseUntil)
+	b, err = json.Marshal(info)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "lease_until")
+}
+
+func TestStorage_LockInfoBreaker(t *testing.T) {
+	// An open breaker fails introspection fast, without calling Firestore.
+	s := New()
+	s.breaker = newCircuitBreaker(1, time.Hour, nil)
+	s.breaker.guard(func() error { return status.Error(codes.Unavailable, "down") })
+
+	_, err := s.LockInfo("key")
+	assert.Equal(t, ErrCircuitOpen, err)
+	_, err = s.ListLocks("")
+	assert.Equal(t, ErrCircuitOpen, err)
+	s.breaker.close()
+}
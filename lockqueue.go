@@ -0,0 +1,194 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"time"
+)
+
+// Fair FIFO queueing for contended locks.
+//
+// With plain Lock, whoever retries first after a release wins, so a busy
+// cluster can starve a node on hot keys such as the ACME account lock. In
+// queue mode (lock_queue), a waiter whose first attempt fails takes a
+// numbered ticket in the "certmagic_lock_tickets" subcollection of the lock
+// document, and a free lock is only granted to the oldest live ticket.
+// Waiters keep their tickets fresh like holders keep their locks fresh;
+// stale tickets of dead waiters are reaped by whoever finds them.
+
+// TTL policies apply to every collection of a name in the database, so the
+// name is specific to this module.
+const ticketCollection = "certmagic_lock_tickets"
+
+// LockTicket is a waiter's place in the queue for a lock.
+type LockTicket struct {
+	Owner       string    `firestore:"owner"`
+	Seq         int64     `firestore:"seq"`
+	RefreshedAt time.Time `firestore:"refreshedAt"`
+	ExpiresAt   time.Time `firestore:"expiresAt"`
+
+	// Stops refreshing the ticket.
+	stop context.CancelFunc
+}
+
+// joinQueue takes the next ticket for key and keeps it fresh until
+// leaveQueue.
+func (s *Storage) joinQueue(ctx context.Context, key string) (*LockTicket, error) {
+	var seq int64
+	ref := s.lockRef(key)
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		doc, err := t.Get(ref)
+		if err != nil && !IsDocNotFound(err) {
+			return err
+		}
+		exists := err == nil
+
+		var lock LockRecord
+		if exists {
+			if err := doc.DataTo(&lock); err != nil {
+				return err
+			}
+		}
+
+		// The lock document (and its counter) may have been removed by the
+		// TTL policy while tickets lived on. Never hand out a used number.
+		seq = lock.NextTicket
+		last, err := t.Documents(ref.Collection(ticketCollection).OrderBy("seq", firestore.Desc).Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, ticketDoc := range last {
+			var ticket LockTicket
+			if err := ticketDoc.DataTo(&ticket); err != nil {
+				return err
+			}
+			if ticket.Seq > seq {
+				seq = ticket.Seq
+			}
+		}
+		seq++
+
+		if exists {
+			err = t.Update(ref, []firestore.Update{{Path: "nextTicket", Value: seq}})
+		} else {
+			err = t.Create(ref, map[string]interface{}{
+				"released":   true,
+				"nextTicket": seq,
+				"expiresAt":  s.expiresAt(doc.ReadTime),
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		return t.Create(s.ticketRef(key, seq), map[string]interface{}{
+			"owner":       s.owner,
+			"seq":         seq,
+			"refreshedAt": firestore.ServerTimestamp,
+			"expiresAt":   s.expiresAt(doc.ReadTime),
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to queue for lock %s: %w", key, err)
+	}
+
+	ticketCtx, stop := context.WithCancel(ctx)
+	ticket := &LockTicket{Owner: s.owner, Seq: seq, stop: stop}
+	go s.keepTicketFresh(ticketCtx, key, ticket)
+
+	return ticket, nil
+}
+
+// leaveQueue stops refreshing ticket. Unless the lock was acquired, which
+// consumes the ticket, the ticket is removed from the queue.
+func (s *Storage) leaveQueue(key string, ticket *LockTicket, acquired bool) {
+	ticket.stop()
+	if acquired {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.staleAfter())
+	defer cancel()
+	if _, err := s.ticketRef(key, ticket.Seq).Delete(ctx); err != nil {
+		// It will be reaped once stale.
+		s.logger.Warnf("unable to leave queue for lock %s: %v", key, err)
+	}
+}
+
+// keepTicketFresh maintains refreshedAt so the ticket isn't reaped while
+// its waiter is alive.
+func (s *Storage) keepTicketFresh(ctx context.Context, key string, ticket *LockTicket) {
+	interval := time.Duration(s.FreshnessSeconds) * time.Second
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		err := s.refreshTicket(ctx, key, ticket)
+		if err != nil && ctx.Err() == nil {
+			if IsDocNotFound(err) {
+				// Consumed or reaped.
+				return
+			}
+			s.logger.Warnf("unable to refresh ticket %d for lock %s: %v", ticket.Seq, key, err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// refreshTicket refreshes ticket. Like lock refreshes, its expiry is based
+// on the server time, so that skewed clocks don't expire it early or late.
+func (s *Storage) refreshTicket(ctx context.Context, key string, ticket *LockTicket) error {
+	ref := s.ticketRef(key, ticket.Seq)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		doc, err := t.Get(ref)
+		if err != nil {
+			return err
+		}
+		s.observeServerTime(doc.ReadTime)
+
+		return t.Update(ref, []firestore.Update{
+			{Path: "refreshedAt", Value: firestore.ServerTimestamp},
+			{Path: "expiresAt", Value: s.expiresAt(doc.ReadTime)},
+		})
+	})
+}
+
+// queueHead reads the queue for key in t and returns the oldest live ticket,
+// if any, along with the stale tickets to reap. now is the server time.
+func (s *Storage) queueHead(t *firestore.Transaction, key string, now time.Time) (*LockTicket, []*firestore.DocumentRef, error) {
+	docs, err := t.Documents(s.lockRef(key).Collection(ticketCollection).OrderBy("seq", firestore.Asc)).GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var head *LockTicket
+	var stale []*firestore.DocumentRef
+	for _, doc := range docs {
+		var ticket LockTicket
+		if err := doc.DataTo(&ticket); err != nil {
+			return nil, nil, err
+		}
+
+		if s.isStale(ticket.RefreshedAt, now) {
+			stale = append(stale, doc.Ref)
+		} else if head == nil {
+			head = &ticket
+		}
+	}
+
+	return head, stale, nil
+}
+
+func (s *Storage) ticketRef(key string, seq int64) *firestore.DocumentRef {
+	// Zero padded so document IDs sort like sequence numbers.
+	return s.lockRef(key).Collection(ticketCollection).Doc(fmt.Sprintf("%020d", seq))
+}
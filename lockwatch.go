@@ -0,0 +1,108 @@
+package storagefirestore
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// lockWatch follows a lock document with a snapshot listener so that
+// waiters can retry as soon as the lock is released or goes stale,
+// rather than polling for it.
+type lockWatch struct {
+	// Receives when the lock may be free to acquire.
+	C <-chan struct{}
+
+	// Closed if the listener fails. Waiters fall back to polling.
+	failed <-chan struct{}
+
+	stop context.CancelFunc
+}
+
+// watchLock starts listening to the lock document for key. The listener
+// runs until ctx is done or stop is called.
+func (s *Storage) watchLock(ctx context.Context, key string) *lockWatch {
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan struct{}, 1)
+	failed := make(chan struct{})
+
+	go s.runLockWatch(ctx, key, c, failed)
+
+	return &lockWatch{C: c, failed: failed, stop: cancel}
+}
+
+func (s *Storage) runLockWatch(ctx context.Context, key string, c chan<- struct{}, failed chan<- struct{}) {
+	notify := func() {
+		select {
+		case c <- struct{}{}:
+		default: // A notification is already pending.
+		}
+	}
+
+	var m sync.Mutex
+	var staleTimer *time.Timer
+	setStaleTimer := func(d time.Duration) {
+		m.Lock()
+		defer m.Unlock()
+		if staleTimer != nil {
+			staleTimer.Stop()
+			staleTimer = nil
+		}
+		if d >= 0 {
+			staleTimer = time.AfterFunc(d, notify)
+		}
+	}
+	defer setStaleTimer(-1)
+
+	it := s.lockRef(key).Snapshots(ctx)
+	defer it.Stop()
+
+	for {
+		doc, err := it.Next()
+		if err != nil {
+			if ctx.Err() == nil && status.Code(err) != codes.Canceled {
+				s.logger.Warnf("lock listener for %s failed, falling back to polling: %v", key, err)
+				close(failed)
+			}
+			return
+		}
+
+		if !doc.Exists() {
+			setStaleTimer(-1)
+			notify()
+			continue
+		}
+
+		var lock LockRecord
+		if err := doc.DataTo(&lock); err != nil {
+			s.logger.Warnf("lock listener for %s failed, falling back to polling: %v", key, err)
+			close(failed)
+			return
+		}
+
+		if lock.Released {
+			setStaleTimer(-1)
+			notify()
+			continue
+		}
+
+		// Still held. Retry when it would go stale unless refreshed, which
+		// produces another snapshot and pushes the timer out again.
+		untilStale := untilStale(s.expiryOf(&lock), doc.ReadTime)
+		setStaleTimer(untilStale)
+	}
+}
+
+// untilStale returns how long until a lock expiring at expiresAt goes stale,
+// given the server time now. A small margin makes sure the lock is
+// actually stale by the time the retry reaches the server.
+func untilStale(expiresAt, now time.Time) time.Duration {
+	const margin = 100 * time.Millisecond
+	d := expiresAt.Sub(now) + margin
+	if d < 0 {
+		return 0
+	}
+	return d
+}
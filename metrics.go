@@ -0,0 +1,155 @@
+package storagefirestore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// define and register the metrics used in this package.
+//
+// They're registered with the default registry, which Caddy exposes on
+// the admin API's /metrics endpoint.
+func init() {
+	const ns, sub = "caddy", "storage_firestore"
+
+	lockMetrics.refreshFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_refresh_failures_total",
+		Help:      "Number of failed attempts to refresh a held lock.",
+	})
+	lockMetrics.lost = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "locks_lost_total",
+		Help:      "Number of locks lost while still held.",
+	})
+	lockMetrics.attempts = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_acquire_attempts",
+		Help:      "Number of attempts it took to acquire a lock.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	})
+	lockMetrics.longHolds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "long_lock_holds_total",
+		Help:      "Number of locks held longer than the long hold warning threshold.",
+	})
+	lockMetrics.longHeld = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "long_held_locks",
+		Help:      "Number of locks currently held longer than the long hold warning threshold.",
+	})
+	cacheMetrics.hits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_hits_total",
+		Help:      "Number of reads served from the record cache.",
+	})
+	cacheMetrics.misses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_misses_total",
+		Help:      "Number of reads the record cache could not serve.",
+	})
+	cacheMetrics.evictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_evictions_total",
+		Help:      "Number of records evicted from the full record cache.",
+	})
+	cacheMetrics.staleHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_stale_hits_total",
+		Help:      "Number of expired records served because Firestore was unavailable.",
+	})
+	mirrorMetrics.fallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "mirror_fallbacks_total",
+		Help:      "Number of reads served from the local mirror because Firestore failed.",
+	})
+	writeQueueMetrics.depth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "write_queue_depth",
+		Help:      "Number of writes waiting in the write queue.",
+	})
+	writeQueueMetrics.replayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "write_queue_replayed_total",
+		Help:      "Number of queued writes replayed to Firestore.",
+	})
+	writeQueueMetrics.conflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "write_queue_conflicts_total",
+		Help:      "Number of queued writes dropped because a newer write superseded them.",
+	})
+	writeQueueMetrics.failures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "write_queue_failures_total",
+		Help:      "Number of queued writes dropped because Firestore rejected them.",
+	})
+	breakerMetrics.open = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "breakers_open",
+		Help:      "Number of circuit breakers currently open.",
+	})
+	breakerMetrics.opened = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "breaker_opened_total",
+		Help:      "Number of times a circuit breaker opened.",
+	})
+	breakerMetrics.rejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "breaker_rejected_total",
+		Help:      "Number of calls failed fast by an open circuit breaker.",
+	})
+}
+
+// breakerMetrics is a collection of metrics for the circuit breakers.
+var breakerMetrics = struct {
+	open     prometheus.Gauge
+	opened   prometheus.Counter
+	rejected prometheus.Counter
+}{}
+
+// writeQueueMetrics is a collection of metrics for the write queue.
+var writeQueueMetrics = struct {
+	depth     prometheus.Gauge
+	replayed  prometheus.Counter
+	conflicts prometheus.Counter
+	failures  prometheus.Counter
+}{}
+
+// mirrorMetrics is a collection of metrics for the local mirror.
+var mirrorMetrics = struct {
+	fallbacks prometheus.Counter
+}{}
+
+// cacheMetrics is a collection of metrics for the record cache.
+var cacheMetrics = struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+	staleHits prometheus.Counter
+}{}
+
+// lockMetrics is a collection of metrics that can be tracked for locks.
+var lockMetrics = struct {
+	refreshFailures prometheus.Counter
+	lost            prometheus.Counter
+	attempts        prometheus.Histogram
+	longHolds       prometheus.Counter
+	longHeld        prometheus.Gauge
+}{}
@@ -0,0 +1,133 @@
+package storagefirestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A local mirror of the records, for when Firestore can't be reached.
+//
+// With mirror_dir set, every record this instance loads from or stores to
+// Firestore is also written to a file there, still encrypted with the AES
+// key. If Firestore fails (as opposed to not having the key), reads fall
+// back to the mirror so Caddy can keep serving the certificates it already
+// has. Copies older than mirror_max_age_seconds are not served.
+
+// mirroredRecord is the file kept for each key.
+type mirroredRecord struct {
+	// Ciphertext, as stored in Firestore.
+	Raw       []byte    `json:"raw"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Size      int64     `json:"size"`
+
+	// When the record was last known to be current.
+	MirroredAt time.Time `json:"mirrored_at"`
+}
+
+// mirror saves the encrypted record for key. Failures are only logged.
+func (s *Storage) mirror(key string, encrypted *Record) {
+	if s.MirrorDir == "" {
+		return
+	}
+
+	b, err := json.Marshal(&mirroredRecord{
+		Raw:        encrypted.Raw,
+		CreatedAt:  encrypted.CreatedAt,
+		UpdatedAt:  encrypted.UpdatedAt,
+		Size:       encrypted.Size,
+		MirroredAt: time.Now(),
+	})
+	if err == nil {
+		err = writeFileAtomic(s.mirrorPath(key), b)
+	}
+	if err != nil {
+		s.logger.Warnf("unable to mirror %s: %v", key, err)
+	}
+}
+
+// unmirror removes the copy of key.
+func (s *Storage) unmirror(key string) {
+	if s.MirrorDir == "" {
+		return
+	}
+
+	if err := os.Remove(s.mirrorPath(key)); err != nil && !os.IsNotExist(err) {
+		s.logger.Warnf("unable to remove mirrored %s: %v", key, err)
+	}
+}
+
+// loadFromMirror reads and decrypts the copy of key, after Firestore failed
+// with cause. It fails if there is no copy or it is too old.
+func (s *Storage) loadFromMirror(key string, cause error) (*Record, error) {
+	if s.MirrorDir == "" {
+		return nil, cause
+	}
+
+	b, err := ioutil.ReadFile(s.mirrorPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, cause
+		}
+		return nil, err
+	}
+
+	var mirrored mirroredRecord
+	if err := json.Unmarshal(b, &mirrored); err != nil {
+		return nil, fmt.Errorf("corrupt mirrored %s: %w", key, err)
+	}
+
+	age := time.Since(mirrored.MirroredAt)
+	if maxAge := time.Duration(s.MirrorMaxAgeSeconds) * time.Second; maxAge > 0 && age > maxAge {
+		s.logger.Errorf("not serving %s from the local mirror, %s old: %v", key, age.Round(time.Second), cause)
+		return nil, cause
+	}
+
+	plaintext, err := s.decrypt(mirrored.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorMetrics.fallbacks.Inc()
+	s.logger.Warnf("serving %s from the local mirror, %s old: %v", key, age.Round(time.Second), cause)
+
+	return &Record{
+		Raw:       plaintext,
+		CreatedAt: mirrored.CreatedAt,
+		UpdatedAt: mirrored.UpdatedAt,
+		Size:      int64(len(plaintext)),
+	}, nil
+}
+
+// mirrorPath is the file of key, which is escaped into a single file name.
+func (s *Storage) mirrorPath(key string) string {
+	return filepath.Join(s.MirrorDir, url.PathEscape(key))
+}
+
+// writeFileAtomic replaces name with data, readable only by the owner.
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
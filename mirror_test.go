@@ -0,0 +1,85 @@
+package storagefirestore
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newMirrorStorage(t *testing.T) (*Storage, func()) {
+	dir, err := ioutil.TempDir("", "mirror")
+	assert.NoError(t, err)
+
+	s := New()
+	s.AesKey = []byte(testKey)
+	s.MirrorDir = dir
+	s.logger = zap.NewNop().Sugar()
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestStorage_mirror(t *testing.T) {
+	s, cleanup := newMirrorStorage(t)
+	defer cleanup()
+
+	key := "certificates/acme/example.com/example.com.crt"
+	ciphertext, err := s.encrypt([]byte("certificate"))
+	assert.NoError(t, err)
+	updated := UTCNow().Add(-time.Hour)
+	s.mirror(key, &Record{Raw: ciphertext, CreatedAt: updated, UpdatedAt: updated, Size: 11})
+
+	info, err := os.Stat(s.mirrorPath(key))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Encrypted at rest.
+	b, err := ioutil.ReadFile(s.mirrorPath(key))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "certificate")
+
+	fallbacks := testutil.ToFloat64(mirrorMetrics.fallbacks)
+	cause := errors.New("unavailable")
+	cert, err := s.loadFromMirror(key, cause)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("certificate"), cert.Raw)
+	assert.Equal(t, int64(11), cert.Size)
+	assert.True(t, updated.Equal(cert.UpdatedAt))
+	assert.Equal(t, fallbacks+1, testutil.ToFloat64(mirrorMetrics.fallbacks))
+
+	s.unmirror(key)
+	_, err = s.loadFromMirror(key, cause)
+	assert.Equal(t, cause, err)
+}
+
+func TestStorage_mirrorMaxAge(t *testing.T) {
+	s, cleanup := newMirrorStorage(t)
+	defer cleanup()
+
+	key := "too-old"
+	ciphertext, err := s.encrypt([]byte("value"))
+	assert.NoError(t, err)
+	s.mirror(key, &Record{Raw: ciphertext})
+
+	s.MirrorMaxAgeSeconds = 1
+	_, err = s.loadFromMirror(key, errors.New("unavailable"))
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	cause := errors.New("unavailable")
+	_, err = s.loadFromMirror(key, cause)
+	assert.Equal(t, cause, err)
+}
+
+func TestStorage_mirrorDisabled(t *testing.T) {
+	s := New()
+	s.mirror("key", &Record{Raw: []byte("x")})
+	s.unmirror("key")
+
+	cause := errors.New("unavailable")
+	_, err := s.loadFromMirror("key", cause)
+	assert.Equal(t, cause, err)
+}
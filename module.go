@@ -15,6 +15,7 @@ const (
 	EnvNameProjectId      = "CADDY_CLUSTERING_PROJECT_ID"
 	EnvNameAesKeySecretId = "CADDY_CLUSTERING_AES_KEY_SECRET_ID"
 	EnvNameAesKey         = "CADDY_CLUSTERING_AESKEY_BASE64"
+	EnvNameAdminToken     = "CADDY_CLUSTERING_ADMIN_TOKEN"
 )
 
 func init() {
@@ -39,7 +40,35 @@ func (s *Storage) Provision(ctx caddy.Context) error {
 		return err
 	}
 
-	return s.setupAfterProvision(ctx)
+	if err := s.setupAfterProvision(ctx); err != nil {
+		return err
+	}
+
+	registerStorage(s)
+	return nil
+}
+
+// Cleanup runs when Caddy stops or replaces this config. Locks still held
+// are unlocked, so other nodes don't have to wait for them to go stale, and
+// the clients are released, which closes them unless the next config shares
+// them. It gives up on unlocking after shutdownTimeout.
+func (s *Storage) Cleanup() error {
+	unregisterStorage(s)
+	if s.client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		s.unlockAll(ctx)
+	}
+
+	s.stopChangeFeed()
+	s.cache.clear()
+	s.breaker.close()
+
+	queueErr := s.releaseWriteQueue()
+	if err := s.releaseClients(); err != nil {
+		return err
+	}
+	return queueErr
 }
 
 func (s *Storage) loadOverrides(ctx context.Context) error {
@@ -51,6 +80,10 @@ func (s *Storage) loadOverrides(ctx context.Context) error {
 		s.AESKeySecretId = secretId
 	}
 
+	if token, found := os.LookupEnv(EnvNameAdminToken); found && token != "" {
+		s.AdminToken = token
+	}
+
 	if b64Key, found := os.LookupEnv(EnvNameAesKey); found && b64Key != "" {
 		err := s.ingestBase64Key(b64Key)
 		if err != nil {
@@ -83,24 +116,32 @@ func (s *Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if value != "" {
 				s.Collection = value
 			}
+		case "lock_collection":
+			if value != "" {
+				s.LockCollection = value
+			}
 		case "aes_key_secret_id":
 			if value != "" {
 				s.AESKeySecretId = value
 			}
 		case "min_lock_poll_seconds":
 			if value != "" {
-				seconds, err := strconv.Atoi(value)
+				seconds, err := strconv.ParseFloat(value, 64)
 				if err == nil {
 					s.MinPollSeconds = seconds
 				}
 			}
 		case "max_lock_poll_seconds":
 			if value != "" {
-				seconds, err := strconv.Atoi(value)
+				seconds, err := strconv.ParseFloat(value, 64)
 				if err == nil {
 					s.MaxPollSeconds = seconds
 				}
 			}
+		case "lock_backoff":
+			if value != "" {
+				s.LockBackoff = value
+			}
 		case "lock_freshness_seconds":
 			if value != "" {
 				seconds, err := strconv.Atoi(value)
@@ -108,6 +149,105 @@ func (s *Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					s.FreshnessSeconds = seconds
 				}
 			}
+		case "max_clock_skew_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.MaxSkewSeconds = seconds
+				}
+			}
+		case "admin_token":
+			if value != "" {
+				s.AdminToken = value
+			}
+		case "min_force_unlock_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.MinForceUnlockSeconds = seconds
+				}
+			}
+		case "max_lock_hold_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.MaxLockHoldSeconds = seconds
+				}
+			}
+		case "long_lock_hold_warning_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.LongHoldWarningSeconds = seconds
+				}
+			}
+		case "cache_size":
+			if value != "" {
+				size, err := strconv.Atoi(value)
+				if err == nil {
+					s.CacheSize = size
+				}
+			}
+		case "cache_ttl_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.CacheTTLSeconds = seconds
+				}
+			}
+		case "mirror_dir":
+			if value != "" {
+				s.MirrorDir = value
+			}
+		case "mirror_max_age_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.MirrorMaxAgeSeconds = seconds
+				}
+			}
+		case "write_queue_dir":
+			if value != "" {
+				s.WriteQueueDir = value
+			}
+		case "breaker_failures":
+			if value != "" {
+				failures, err := strconv.Atoi(value)
+				if err == nil {
+					s.BreakerFailures = failures
+				}
+			}
+		case "breaker_cooldown_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.BreakerCooldownSeconds = seconds
+				}
+			}
+		case "preload":
+			s.Preload = append(s.Preload, value)
+			s.Preload = append(s.Preload, d.RemainingArgs()...)
+		case "preload_concurrency":
+			if value != "" {
+				concurrency, err := strconv.Atoi(value)
+				if err == nil {
+					s.PreloadConcurrency = concurrency
+				}
+			}
+		case "preload_timeout_seconds":
+			if value != "" {
+				seconds, err := strconv.Atoi(value)
+				if err == nil {
+					s.PreloadTimeoutSeconds = seconds
+				}
+			}
+		case "lock_queue":
+			if value != "" {
+				enabled, err := strconv.ParseBool(value)
+				if err == nil {
+					s.LockQueue = enabled
+				}
+			}
 		case "aes_key":
 			if value != "" {
 				err := s.ingestBase64Key(value)
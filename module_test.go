@@ -11,18 +11,19 @@ import (
 
 func TestStorage_loadOverrides(t *testing.T) {
 	updates := map[string]string{
-		EnvNameProjectId: "fake-override-project",
-		EnvNameAesKey: "YWVzLW92ZXJyaWRlLWtleQ==",
+		EnvNameProjectId:      "fake-override-project",
+		EnvNameAesKey:         "YWVzLW92ZXJyaWRlLWtleQ==",
 		EnvNameAesKeySecretId: "override-secret-id",
+		EnvNameAdminToken:     "override-admin-token",
 	}
 
 	original := map[string]string{}
 	for k, v := range updates {
-		original[k]	= os.Getenv(k)
+		original[k] = os.Getenv(k)
 		os.Setenv(k, v)
 	}
 
-	defer func(){
+	defer func() {
 		for k := range updates {
 			os.Setenv(k, original[k])
 		}
@@ -35,6 +36,7 @@ func TestStorage_loadOverrides(t *testing.T) {
 	assert.Equal(t, updates[EnvNameProjectId], s.ProjectId)
 	assert.Equal(t, []byte("aes-override-key"), s.AesKey)
 	assert.Equal(t, updates[EnvNameAesKeySecretId], "override-secret-id")
+	assert.Equal(t, updates[EnvNameAdminToken], s.AdminToken)
 
 	os.Setenv(EnvNameAesKey, "XXX")
 	err = s.loadOverrides(context.Background())
@@ -47,11 +49,29 @@ func TestStorage_SERDE(t *testing.T) {
     storage firestore {
            project_id             "cf-project-id"
            collection             "cf-collection"
-           min_lock_poll_seconds  24
+           lock_collection        "cf-lock-collection"
+           min_lock_poll_seconds  0.5
            max_lock_poll_seconds  42
            lock_freshness_seconds 100
+           max_clock_skew_seconds 7
+           lock_queue             true
+           lock_backoff           decorrelated
+           max_lock_hold_seconds  600
+           long_lock_hold_warning_seconds 120
+           cache_size             100
+           cache_ttl_seconds      60
+           mirror_dir             "/var/lib/caddy/mirror"
+           mirror_max_age_seconds 3600
+           write_queue_dir        "/var/lib/caddy/queue"
+           breaker_failures       3
+           breaker_cooldown_seconds 10
+           preload                certificates acme
+           preload_concurrency    4
+           preload_timeout_seconds 5
            aes_key                "Y2YtdGVzdC1rZXkxMjM0NQ=="
            aes_key_secret_id      "cf-secret"
+           admin_token            "cf-admin-token"
+           min_force_unlock_seconds 30
     }
 }`)
 	s := New()
@@ -59,11 +79,29 @@ func TestStorage_SERDE(t *testing.T) {
 
 	assert.Equal(t, "cf-project-id", s.ProjectId)
 	assert.Equal(t, "cf-collection", s.Collection)
-	assert.Equal(t, 24, s.MinPollSeconds)
-	assert.Equal(t, 42, s.MaxPollSeconds)
+	assert.Equal(t, "cf-lock-collection", s.LockCollection)
+	assert.Equal(t, 0.5, s.MinPollSeconds)
+	assert.Equal(t, 42.0, s.MaxPollSeconds)
+	assert.Equal(t, BackoffDecorrelated, s.LockBackoff)
+	assert.Equal(t, 600, s.MaxLockHoldSeconds)
+	assert.Equal(t, 120, s.LongHoldWarningSeconds)
+	assert.Equal(t, 100, s.CacheSize)
+	assert.Equal(t, 60, s.CacheTTLSeconds)
+	assert.Equal(t, "/var/lib/caddy/mirror", s.MirrorDir)
+	assert.Equal(t, 3600, s.MirrorMaxAgeSeconds)
+	assert.Equal(t, "/var/lib/caddy/queue", s.WriteQueueDir)
+	assert.Equal(t, 3, s.BreakerFailures)
+	assert.Equal(t, 10, s.BreakerCooldownSeconds)
+	assert.Equal(t, []string{"certificates", "acme"}, s.Preload)
+	assert.Equal(t, 4, s.PreloadConcurrency)
+	assert.Equal(t, 5, s.PreloadTimeoutSeconds)
 	assert.Equal(t, 100, s.FreshnessSeconds)
+	assert.Equal(t, 7, s.MaxSkewSeconds)
+	assert.True(t, s.LockQueue)
 	assert.Equal(t, []byte("cf-test-key12345"), s.AesKey)
 	assert.Equal(t, "cf-secret", s.AESKeySecretId)
+	assert.Equal(t, "cf-admin-token", s.AdminToken)
+	assert.Equal(t, 30, s.MinForceUnlockSeconds)
 
 	// Make sure json works, too.
 	b, err := json.Marshal(s)
@@ -80,4 +118,11 @@ func TestStorage_ingestBase64Key(t *testing.T) {
 	s := New()
 	assert.Error(t, s.ingestBase64Key("!!!!!")) // Bad base64
 	assert.Error(t, s.ingestBase64Key("YmFk"))  // Bad length
-}
\ No newline at end of file
+}
+
+func TestStorage_CleanupUnprovisioned(t *testing.T) {
+	s := New()
+	registerStorage(s)
+	assert.NoError(t, s.Cleanup())
+	assert.Empty(t, activeStorages())
+}
@@ -0,0 +1,164 @@
+package storagefirestore
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"google.golang.org/api/iterator"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Preloading fills the record cache at provision, so that certmagic's
+// first loads don't each wait for a round trip to Firestore.
+//
+// The keys under the preload prefixes are listed without their data, then
+// read with GetAll in batches of preloadBatchSize, up to
+// preload_concurrency batches at a time. Whatever isn't loaded within
+// preload_timeout_seconds is left to be read on demand: preloading never
+// fails provisioning.
+
+// GetAll reads up to 500 documents at once, but smaller batches spread
+// better across workers.
+const preloadBatchSize = 100
+
+// preload reads the records under s.Preload into the cache.
+func (s *Storage) preload(ctx context.Context) {
+	if len(s.Preload) == 0 {
+		return
+	}
+	if s.cache == nil {
+		s.logger.Warnf("preload is set but cache_size is not, not preloading")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.PreloadTimeoutSeconds)*time.Second)
+	defer cancel()
+	start := time.Now()
+
+	refs, err := s.preloadRefs(ctx)
+	if err != nil {
+		s.logger.Warnf("listing keys to preload: %v", err)
+		return
+	}
+
+	concurrency := s.PreloadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	batches := make(chan []*firestore.DocumentRef)
+	var loaded int64
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				n, err := s.preloadBatch(ctx, batch)
+				atomic.AddInt64(&loaded, int64(n))
+				if err != nil && ctx.Err() == nil {
+					s.logger.Warnf("preloading: %v", err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for len(refs) > 0 {
+		n := preloadBatchSize
+		if n > len(refs) {
+			n = len(refs)
+		}
+		select {
+		case batches <- refs[:n]:
+			refs = refs[n:]
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		s.logger.Warnf("preloaded %d records before running out of time after %s", loaded, time.Since(start))
+		return
+	}
+	s.logger.Infof("preloaded %d records in %s", loaded, time.Since(start))
+}
+
+// preloadRefs lists the records under s.Preload, without reading them.
+func (s *Storage) preloadRefs(ctx context.Context) ([]*firestore.DocumentRef, error) {
+	var refs []*firestore.DocumentRef
+	err := s.breaker.guard(func() error {
+		iter := s.client.Collection(s.Collection).DocumentRefs(ctx)
+		for {
+			ref, err := iter.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hasPreloadPrefix(keyFromSafe(ref.ID), s.Preload) {
+				refs = append(refs, ref)
+			}
+		}
+	})
+	return refs, err
+}
+
+// preloadBatch reads refs into the cache and returns how many it cached.
+func (s *Storage) preloadBatch(ctx context.Context, refs []*firestore.DocumentRef) (int, error) {
+	gen := s.cache.generation()
+
+	var docs []*firestore.DocumentSnapshot
+	err := s.breaker.guard(func() (err error) {
+		docs, err = s.client.GetAll(ctx, refs)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	loaded := 0
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		key := keyFromSafe(doc.Ref.ID)
+		s.sawVersion(key, doc.UpdateTime)
+
+		var cert Record
+		if err := doc.DataTo(&cert); err != nil {
+			s.logger.Warnf("preloading %s: %v", key, err)
+			continue
+		}
+		if !cert.hasValue() {
+			// Lock placeholders have no value.
+			continue
+		}
+
+		record, err := s.decryptRecord(key, &cert)
+		if err != nil {
+			s.logger.Warnf("preloading %s: %v", key, err)
+			continue
+		}
+		s.cache.put(key, record, gen)
+		loaded++
+	}
+	return loaded, nil
+}
+
+// hasPreloadPrefix reports whether key is under one of prefixes, which
+// are whole path components: "certificates" covers
+// "certificates/example.com" but not "certificates-old".
+func hasPreloadPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
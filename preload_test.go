@@ -0,0 +1,31 @@
+package storagefirestore
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestHasPreloadPrefix(t *testing.T) {
+	prefixes := []string{"certificates", "acme/"}
+	assert.True(t, hasPreloadPrefix("certificates/acme/example.com/example.com.crt", prefixes))
+	assert.True(t, hasPreloadPrefix("acme/example.com/users/me.json", prefixes))
+	assert.True(t, hasPreloadPrefix("certificates", prefixes))
+	assert.False(t, hasPreloadPrefix("certificates-old/example.com.crt", prefixes))
+	assert.False(t, hasPreloadPrefix("ocsp/example.com", prefixes))
+	assert.False(t, hasPreloadPrefix("ocsp/example.com", nil))
+
+	// An empty prefix covers everything.
+	assert.True(t, hasPreloadPrefix("ocsp/example.com", []string{""}))
+}
+
+func TestStorage_preloadDisabled(t *testing.T) {
+	// Without a cache there is nowhere to preload to, and no client is
+	// needed to find out.
+	s := New()
+	s.logger = zap.NewNop().Sugar()
+	s.Preload = []string{"certificates"}
+	s.preload(context.Background())
+	assert.Nil(t, s.cache)
+}
@@ -1,7 +1,6 @@
 package storagefirestore
 
 import (
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"context"
 	"fmt"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
@@ -12,9 +11,9 @@ import (
 // I don't like storing secrets in environmental variables. Feels like asking
 // for a leak. This method uses Google Secrets Manager instead.
 //
-// TODO: Verify `caddy reload` will provision.
+// The client is shared across `caddy reload`s (see clients.go).
 func (s *Storage) loadAESKeyFromSecret(ctx context.Context) error {
-	client, err := secretmanager.NewClient(ctx)
+	client, err := s.acquireSecretClient()
 	if err != nil {
 		return err
 	}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"github.com/caddyserver/certmagic"
 	"go.uber.org/zap"
+	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 // TODO: Verifications
@@ -16,17 +18,75 @@ import (
 
 // Storage uses Firestore for a backend.
 type Storage struct {
-	ProjectId        string `json:"project_id"`
-	Collection       string `json:"collection"`
-	AESKeySecretId   string `json:"aes_key_secret_id"`
-	MinPollSeconds   int    `json:"min_lock_poll_seconds"`
-	MaxPollSeconds   int    `json:"max_lock_poll_seconds"`
-	FreshnessSeconds int    `json:"lock_freshness_seconds"`
-	AesKey           []byte `json:"aes_key"`
+	ProjectId        string  `json:"project_id"`
+	Collection       string  `json:"collection"`
+	LockCollection   string  `json:"lock_collection"`
+	AESKeySecretId   string  `json:"aes_key_secret_id"`
+	MinPollSeconds   float64 `json:"min_lock_poll_seconds"`
+	MaxPollSeconds   float64 `json:"max_lock_poll_seconds"`
+	LockBackoff      string  `json:"lock_backoff"`
+	FreshnessSeconds int     `json:"lock_freshness_seconds"`
+	MaxSkewSeconds   int     `json:"max_clock_skew_seconds"`
+	LockQueue        bool    `json:"lock_queue"`
+	AesKey           []byte  `json:"aes_key"`
+
+	// AdminToken authenticates force unlocks through the admin API. They
+	// are disabled unless it is set.
+	AdminToken            string `json:"admin_token"`
+	MinForceUnlockSeconds int    `json:"min_force_unlock_seconds"`
+
+	// Locks expire this long after being acquired, even if refreshed. 0
+	// means no limit. Holding a lock longer than LongHoldWarningSeconds
+	// logs a warning.
+	MaxLockHoldSeconds     int `json:"max_lock_hold_seconds"`
+	LongHoldWarningSeconds int `json:"long_lock_hold_warning_seconds"`
+
+	// Up to CacheSize decrypted records are cached for CacheTTLSeconds (see
+	// cache.go). 0 disables the cache.
+	CacheSize       int `json:"cache_size"`
+	CacheTTLSeconds int `json:"cache_ttl_seconds"`
+
+	// Records are mirrored to MirrorDir, if set, and read from there while
+	// Firestore is failing, up to MirrorMaxAgeSeconds old (see mirror.go).
+	MirrorDir           string `json:"mirror_dir"`
+	MirrorMaxAgeSeconds int    `json:"mirror_max_age_seconds"`
+
+	// Stores failing while Firestore is unavailable are queued in
+	// WriteQueueDir, if set, and replayed later (see writequeue.go).
+	WriteQueueDir string `json:"write_queue_dir"`
+
+	// The circuit breaker opens after BreakerFailures consecutive failures
+	// (0 disables it) and probes again after BreakerCooldownSeconds (see
+	// breaker.go).
+	BreakerFailures        int `json:"breaker_failures"`
+	BreakerCooldownSeconds int `json:"breaker_cooldown_seconds"`
+
+	// The records under the Preload prefixes are read into the cache at
+	// provision, PreloadConcurrency batches at a time, for up to
+	// PreloadTimeoutSeconds (see preload.go).
+	Preload               []string `json:"preload,omitempty"`
+	PreloadConcurrency    int      `json:"preload_concurrency"`
+	PreloadTimeoutSeconds int      `json:"preload_timeout_seconds"`
 
 	client *firestore.Client
 	logger *zap.SugaredLogger
 
+	// This instance's shares of the pooled clients (see clients.go).
+	firestoreKey *clientKey
+	secretKey    *clientKey
+
+	cache   *recordCache
+	queue   *writeQueue
+	breaker *circuitBreaker
+
+	// Change feed subscribers, and how to stop the feed. Guarded by m.
+	onChange []func(ChangeEvent)
+	stopFeed context.CancelFunc
+
+	// Identify this instance as a lock owner.
+	owner    string
+	hostname string
+
 	// > Implementations of Storage must be safe for concurrent use.
 	//
 	// The consul implementation didn't seem to use a mutex to guard
@@ -35,15 +95,35 @@ type Storage struct {
 	// actual call to Lock() and Unlock() in storage aren't in the critical
 	// section. I added a mutex to the local locks because I'd rather be
 	// safe, but it may be worth tracing the access path through certmagic.
-	locks map[string]context.CancelFunc
+	locks map[string]*heldLock
 	m     sync.Mutex
 
+	// Queues goroutines of this process waiting on the same key, so
+	// that only one of them at a time holds the remote lock.
+	localLocks map[string]*localLock
+
+	// Numbers the local holds, so that only the holder releases one.
+	// Guarded by m.
+	localHolds uint64
+
+	// When clock skew was last warned about. Guarded by m.
+	lastSkewWarning time.Time
+
+	// Server update times of the records, for the write queue (see
+	// writequeue.go). Guarded by m.
+	versions map[string]time.Time
+
 	certmagic.Storage
 }
 
 const (
 	DefaultCollection = "certmagic"
 
+	// Locks are kept in their own collection so that lock refreshes never
+	// touch certificate documents. Configure a TTL policy on its expiresAt
+	// field to have Firestore delete abandoned locks.
+	DefaultLockCollection = "certmagic_locks"
+
 	// The certmagic/filestorage.go uses a 1 second polling interval.
 	// I'm using that as the minimum, but making it take up to 5 seconds
 	// (uniformly distributed) because firestore has to do network
@@ -52,121 +132,419 @@ const (
 	DefaultMinPollSeconds = 1
 	DefaultMaxPollSeconds = 5
 
+	// Polling only happens when the lock listener fails, so the historical
+	// uniform spread is good enough by default.
+	DefaultLockBackoff = BackoffUniform
+
 	// How often to update the lock's timestamp. Locks older than this
 	// can be considered stale (e.g. failed process). Five seconds
 	// is okay for as ingle document. The maximum sustained write rate
 	// according to the firestore quotas is 1 per second.
 	DefaultFreshnessIntervalSeconds = 5
+
+	// Lock times come from the Firestore server, so node clocks don't have
+	// to agree. A node drifting further than this from the server is still
+	// worth a warning: certmagic itself uses the local clock for renewals.
+	DefaultMaxSkewSeconds = 2
+
+	// Locks younger than this can only be force unlocked with force set.
+	DefaultMinForceUnlockSeconds = 60
+
+	// Cached records are normally invalidated by a listener. The TTL only
+	// bounds how stale they get if it misses a change.
+	DefaultCacheTTLSeconds = 300
+
+	// Certificates are renewed with a third of their lifetime (30 days for
+	// Let's Encrypt) left. A month old copy is still valid.
+	DefaultMirrorMaxAgeSeconds = 30 * 24 * 60 * 60
+
+	// A few timeouts in a row mean Firestore is down rather than slow.
+	DefaultBreakerFailures        = 5
+	DefaultBreakerCooldownSeconds = 30
+
+	// Preloading delays startup, so it gets a few seconds at most.
+	DefaultPreloadConcurrency    = 8
+	DefaultPreloadTimeoutSeconds = 10
+
+	// Issuing a certificate takes seconds to a few minutes. Holding a
+	// lock for much longer than that is worth a look.
+	DefaultLongHoldWarningSeconds = 300
 )
 
 func New() *Storage {
 	return &Storage{
-		Collection:       DefaultCollection,
-		MinPollSeconds:   DefaultMinPollSeconds,
-		MaxPollSeconds:   DefaultMaxPollSeconds,
-		FreshnessSeconds: DefaultFreshnessIntervalSeconds,
-		locks:            map[string]context.CancelFunc{},
+		Collection:             DefaultCollection,
+		LockCollection:         DefaultLockCollection,
+		MinPollSeconds:         DefaultMinPollSeconds,
+		MaxPollSeconds:         DefaultMaxPollSeconds,
+		LockBackoff:            DefaultLockBackoff,
+		FreshnessSeconds:       DefaultFreshnessIntervalSeconds,
+		MaxSkewSeconds:         DefaultMaxSkewSeconds,
+		MinForceUnlockSeconds:  DefaultMinForceUnlockSeconds,
+		LongHoldWarningSeconds: DefaultLongHoldWarningSeconds,
+		CacheTTLSeconds:        DefaultCacheTTLSeconds,
+		MirrorMaxAgeSeconds:    DefaultMirrorMaxAgeSeconds,
+		BreakerFailures:        DefaultBreakerFailures,
+		BreakerCooldownSeconds: DefaultBreakerCooldownSeconds,
+		PreloadConcurrency:     DefaultPreloadConcurrency,
+		PreloadTimeoutSeconds:  DefaultPreloadTimeoutSeconds,
+		locks:                  map[string]*heldLock{},
 	}
 }
 
+// heldLock is the local state of a remote lock this instance holds.
+type heldLock struct {
+	token  string
+	fence  int64
+	cancel context.CancelFunc
+
+	// The local hold of the key (see acquireLocal), released on unlock.
+	// Zero for locks taken with attemptLock alone.
+	localHold uint64
+
+	// Local time of acquisition, and whether the hold was reported as long
+	// (guarded by Storage.m).
+	acquiredAt time.Time
+	longHeld   bool
+
+	// Done once the lock is lost or released.
+	lost     context.Context
+	markLost context.CancelFunc
+}
+
+func newHeldLock(token string, fence int64) *heldLock {
+	lost, markLost := context.WithCancel(context.Background())
+	return &heldLock{token: token, fence: fence, acquiredAt: time.Now(), lost: lost, markLost: markLost}
+}
+
 func (s *Storage) setupAfterProvision(ctx context.Context) error {
-	client, err := firestore.NewClient(ctx, s.ProjectId)
+	if err := validBackoff(s.LockBackoff); err != nil {
+		return err
+	}
+
+	client, err := s.acquireFirestoreClient()
 	if err != nil {
 		return err
 	}
 	s.client = client
 
-	if s.AESKeySecretId == "" {
-		return nil
+	if s.logger == nil {
+		s.logger = zap.NewNop().Sugar()
+	}
+
+	if err := s.identify(); err != nil {
+		return err
+	}
+
+	if s.BreakerFailures > 0 {
+		cooldown := time.Duration(s.BreakerCooldownSeconds) * time.Second
+		s.breaker = newCircuitBreaker(s.BreakerFailures, cooldown, s.logBreakerChange)
+	}
+
+	if s.CacheSize > 0 {
+		s.cache = newRecordCache(s.CacheSize, time.Duration(s.CacheTTLSeconds)*time.Second)
+		s.startChangeFeed()
+	}
+
+	if s.WriteQueueDir != "" {
+		if err := s.acquireWriteQueue(); err != nil {
+			return err
+		}
 	}
 
-	return s.loadAESKeyFromSecret(ctx)
+	if s.AESKeySecretId != "" {
+		if err := s.loadAESKeyFromSecret(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.preload(ctx)
+	return nil
 }
 
+// Store saves value at key.
+//
+// If this instance holds the lock guarding key (see fence.go), the write
+// carries that lock's fencing number and is rejected with ErrStaleFence
+// once a newer holder has taken the lock over.
+//
+// With a write queue configured, writes failing because Firestore is
+// unavailable are queued and replayed later (see writequeue.go).
 func (s *Storage) Store(key string, value []byte) error {
-	ref := s.keyToRef(key)
+	lockName, fence := s.heldFence(key)
 
 	ciphertext, err := s.encrypt(value)
 	if err != nil {
 		return err
 	}
+
+	return s.write(&queuedWrite{
+		Key:       key,
+		Raw:       ciphertext,
+		Size:      int64(len(value)),
+		Fence:     fence,
+		FenceLock: lockName,
+		QueuedAt:  UTCNow(),
+	})
+}
+
+// write stores w, or queues it if Firestore is unavailable.
+func (s *Storage) write(w *queuedWrite) error {
+	defer s.cache.invalidate(w.Key)
+
 	// TODO: add context timeout
-	return s.client.RunTransaction(context.Background(), func(ctx context.Context, t *firestore.Transaction) error {
-		if _, err := t.Get(ref); err != nil {
-			if IsDocNotFound(err) {
-				// Technically, I don't *think* this is possible. I think the lock
-				// MUST be called first, so the document MUST exist at this point.
-				now := UTCNow()
-				return t.Create(ref, &Record{
-					Raw:       ciphertext,
-					CreatedAt: now,
-					UpdatedAt: now,
-				})
-			} else {
+	err := s.storeEncrypted(context.Background(), w, false)
+	if s.queue == nil {
+		return err
+	}
+	switch {
+	case err == nil:
+		// Older queued writes of the key would be read instead.
+		s.queue.discard(w.Key)
+	case isUnavailable(err):
+		return s.enqueueWrite(w, err)
+	}
+	return err
+}
+
+// storeEncrypted writes w. Replayed writes fail with errWriteConflict if
+// the record isn't at the version w was queued over anymore.
+func (s *Storage) storeEncrypted(ctx context.Context, w *queuedWrite, replay bool) error {
+	ref := s.keyToRef(w.Key)
+
+	var stored *Record
+	err := s.runTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		if err := s.checkFence(t, w.fenceLock(), w.Fence); err != nil {
+			return err
+		}
+
+		now := UTCNow()
+		stored = &Record{
+			Raw:       w.Raw,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Fence:     w.Fence,
+			Size:      w.Size,
+		}
+
+		doc, err := t.Get(ref)
+		if err != nil {
+			if !IsDocNotFound(err) {
 				return err
 			}
+			if replay && !w.UpdateTime.IsZero() {
+				// Deleted since.
+				return errWriteConflict
+			}
+			return t.Create(ref, stored)
+		}
+
+		var cert Record
+		if err := doc.DataTo(&cert); err != nil {
+			return err
+		}
+		if w.Fence != 0 && cert.Fence > w.Fence {
+			return ErrStaleFence
+		}
+		var preconditions []firestore.Precondition
+		if replay {
+			if !doc.UpdateTime.Equal(w.UpdateTime) {
+				return errWriteConflict
+			}
+			preconditions = append(preconditions, firestore.LastUpdateTime(w.UpdateTime))
 		}
+		stored.CreatedAt = cert.CreatedAt
 
-		return t.Update(ref, []firestore.Update{
-			{Path: "updatedAt", Value: UTCNow()},
-			{Path: "raw", Value: ciphertext},
-		})
+		updates := []firestore.Update{
+			{Path: "updatedAt", Value: now},
+			{Path: "raw", Value: w.Raw},
+			{Path: "size", Value: w.Size},
+		}
+		if w.Fence > cert.Fence {
+			updates = append(updates, firestore.Update{Path: "fence", Value: w.Fence})
+		}
+		return t.Update(ref, updates, preconditions...)
 	})
+
+	if err != nil {
+		return err
+	}
+	s.mirror(w.Key, stored)
+	s.readVersion(w.Key)
+	return nil
 }
 
 func (s *Storage) Load(key string) ([]byte, error) {
-	c, err := s.loadAndDecrypt(key)
+	c, err := s.loadRecord(key)
 	if err != nil {
 		return nil, err
 	}
 	return c.Raw, nil
 }
 
+// loadRecord is loadAndDecrypt through the write queue and the cache.
+func (s *Storage) loadRecord(key string) (*Record, error) {
+	if cert, found, err := s.queuedRecord(key); found || err != nil {
+		return cert, err
+	}
+
+	if cert, found := s.cache.get(key); found {
+		return cert, nil
+	}
+
+	gen := s.cache.generation()
+	cert, err := s.loadAndDecrypt(key)
+	if err != nil {
+		return s.staleRecord(key, err)
+	}
+	s.cache.put(key, cert, gen)
+	return cert, nil
+}
+
+// fallbackRecord returns the copy of key to serve after reading it from
+// Firestore failed with err: the mirrored one, or else an expired cache
+// entry if Firestore is unavailable.
+func (s *Storage) fallbackRecord(key string, err error) (*Record, error) {
+	cert, err := s.loadFromMirror(key, err)
+	if err != nil {
+		return s.staleRecord(key, err)
+	}
+	return cert, nil
+}
+
+// staleRecord returns the expired cache entry for key if loading it failed
+// because Firestore is unavailable, and err otherwise.
+func (s *Storage) staleRecord(key string, err error) (*Record, error) {
+	if isUnavailable(err) {
+		if stale, found := s.cache.getStale(key); found {
+			s.logger.Warnf("serving stale cached %s: %v", key, err)
+			return stale, nil
+		}
+	}
+	return nil, err
+}
+
 func (s *Storage) loadAndDecrypt(key string) (*Record, error) {
 	// TODO: add timeout
-	doc, err := s.keyToRef(key).Get(context.Background())
+	doc, err := s.getDoc(key)
 	if err != nil {
 		if IsDocNotFound(err) {
 			return nil, certmagic.ErrNotExist(err)
 		} else {
-			// TODO: log
-			return nil, err
+			return s.loadFromMirror(key, err)
 		}
 	}
+	return s.decryptDoc(key, doc)
+}
+
+// decryptDoc decodes the record read for key and decrypts it.
+func (s *Storage) decryptDoc(key string, doc *firestore.DocumentSnapshot) (*Record, error) {
+	s.sawVersion(key, doc.UpdateTime)
 
 	var cert Record
-	err = doc.DataTo(&cert)
+	err := doc.DataTo(&cert)
 	if err != nil {
 		// TODO: LOG
 		return nil, err
 	}
 
+	if !cert.hasValue() {
+		return nil, certmagic.ErrNotExist(fmt.Errorf("key %s not found", key))
+	}
+	return s.decryptRecord(key, &cert)
+}
+
+// decryptRecord decrypts cert, read for key, in place.
+func (s *Storage) decryptRecord(key string, cert *Record) (*Record, error) {
 	plaintext, err := s.decrypt(cert.Raw)
 	if err != nil {
 		return nil, err
 	}
+	s.mirror(key, cert)
+
 	cert.Raw = plaintext
-	return &cert, nil
+	return cert, nil
 }
 
+// Delete removes key. Like Store, it is fenced by the lock guarding key if
+// this instance holds it. Keys only in the write queue are deleted by
+// dropping their queued writes.
 func (s *Storage) Delete(key string) error {
 	ref := s.keyToRef(key)
+	lockName, fence := s.heldFence(key)
+	defer s.cache.invalidate(key)
 
-	return s.client.RunTransaction(context.Background(), func(ctx context.Context, t *firestore.Transaction) error {
-		if _, err := t.Get(ref); err != nil {
+	var missing bool
+	err := s.runTransaction(context.Background(), func(ctx context.Context, t *firestore.Transaction) error {
+		missing = false
+		if err := s.checkFence(t, lockName, fence); err != nil {
+			return err
+		}
+
+		doc, err := t.Get(ref)
+		if err != nil {
 			if IsDocNotFound(err) {
+				missing = true
 				return certmagic.ErrNotExist(err)
 			}
 			return err
 		}
 
+		var cert Record
+		if err := doc.DataTo(&cert); err != nil {
+			return err
+		}
+
+		if !cert.hasValue() {
+			// Only a lock placeholder. Leave the lock state alone.
+			missing = true
+			return certmagic.ErrNotExist(fmt.Errorf("key %s not found", key))
+		}
+
+		if fence != 0 && cert.Fence > fence {
+			return ErrStaleFence
+		}
+
 		return t.Delete(ref)
 	})
+
+	if missing && s.queue != nil && s.queue.latest(key) != nil {
+		// Only stored in the write queue so far.
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	s.unmirror(key)
+	s.sawVersion(key, time.Time{})
+	if s.queue != nil {
+		s.queue.discard(key)
+	}
+	return nil
 }
 
 func (s *Storage) Exists(key string) bool {
-	_, err := s.keyToRef(key).Get(context.Background())
-	return err == nil
+	if _, found, _ := s.queuedRecord(key); found {
+		return true
+	}
+	if _, found := s.cache.get(key); found {
+		return true
+	}
+
+	doc, err := s.getDoc(key)
+	if err != nil {
+		if IsDocNotFound(err) {
+			return false
+		}
+		_, err := s.fallbackRecord(key, err)
+		return err == nil
+	}
+
+	var cert Record
+	if err := doc.DataTo(&cert); err != nil {
+		return false
+	}
+	return cert.hasValue()
 }
 
 func (s *Storage) List(prefix string, recursive bool) ([]string, error) {
@@ -175,15 +553,28 @@ func (s *Storage) List(prefix string, recursive bool) ([]string, error) {
 	// TODO: add timeout
 	// TODO: use sub collections instead for optimization
 	// TODO: look at List() usage
-	snapshots, err := s.client.Collection(s.Collection).Documents(context.Background()).GetAll()
+	var snapshots []*firestore.DocumentSnapshot
+	err := s.breaker.guard(func() (err error) {
+		snapshots, err = s.client.Collection(s.Collection).Documents(context.Background()).GetAll()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	translatedPrefix := firestoreSafeKey(prefix)
 	for _, snapshot := range snapshots {
-		if strings.HasPrefix(snapshot.Ref.ID, translatedPrefix) {
-			keysFound = append(keysFound, strings.ReplaceAll(snapshot.Ref.ID, "\\", "/"))
+		if !strings.HasPrefix(snapshot.Ref.ID, translatedPrefix) {
+			continue
+		}
+
+		var cert Record
+		if err := snapshot.DataTo(&cert); err != nil {
+			return nil, err
+		}
+
+		if cert.hasValue() {
+			keysFound = append(keysFound, keyFromSafe(snapshot.Ref.ID))
 		}
 	}
 
@@ -213,7 +604,7 @@ func (s *Storage) List(prefix string, recursive bool) ([]string, error) {
 }
 
 func (s *Storage) Stat(key string) (certmagic.KeyInfo, error) {
-	c, err := s.loadAndDecrypt(key)
+	c, err := s.statRecord(key)
 	if err != nil {
 		return certmagic.KeyInfo{}, err
 	}
@@ -221,7 +612,95 @@ func (s *Storage) Stat(key string) (certmagic.KeyInfo, error) {
 	return certmagic.KeyInfo{
 		Key:        key,
 		Modified:   c.UpdatedAt,
-		Size:       int64(len(c.Raw)),
+		Size:       c.Size,
 		IsTerminal: false,
 	}, nil
 }
+
+// statRecord returns the record for key with Size set. Only records
+// written before sizes were stored are decrypted.
+func (s *Storage) statRecord(key string) (*Record, error) {
+	if cert, found, err := s.queuedRecord(key); found || err != nil {
+		return cert, err
+	}
+
+	if cert, found := s.cache.get(key); found {
+		cert.Size = int64(len(cert.Raw))
+		return cert, nil
+	}
+
+	doc, err := s.getDoc(key)
+	if err != nil {
+		if IsDocNotFound(err) {
+			return nil, certmagic.ErrNotExist(err)
+		}
+		cert, err := s.fallbackRecord(key, err)
+		if err != nil {
+			return nil, err
+		}
+		cert.Size = int64(len(cert.Raw))
+		return cert, nil
+	}
+
+	s.sawVersion(key, doc.UpdateTime)
+
+	var cert Record
+	if err := doc.DataTo(&cert); err != nil {
+		return nil, err
+	}
+
+	if !cert.hasValue() {
+		return nil, certmagic.ErrNotExist(fmt.Errorf("key %s not found", key))
+	}
+
+	if _, err := doc.DataAt("size"); err != nil {
+		// Written before sizes were stored. An empty value has a stored
+		// size of 0, so only the missing field tells these apart.
+		legacy, err := s.loadRecord(key)
+		if err != nil {
+			return nil, err
+		}
+		legacy.Size = int64(len(legacy.Raw))
+		return legacy, nil
+	}
+	return &cert, nil
+}
+
+// getDoc reads the record document of key, through the circuit breaker.
+func (s *Storage) getDoc(key string) (*firestore.DocumentSnapshot, error) {
+	var doc *firestore.DocumentSnapshot
+	err := s.breaker.guard(func() (err error) {
+		doc, err = s.keyToRef(key).Get(context.Background())
+		return err
+	})
+	return doc, err
+}
+
+// runTransaction runs f in a transaction, through the circuit breaker.
+func (s *Storage) runTransaction(ctx context.Context, f func(context.Context, *firestore.Transaction) error) error {
+	return s.breaker.guard(func() error {
+		return s.client.RunTransaction(ctx, f)
+	})
+}
+
+// identify sets the owner ID and hostname recorded on the locks this
+// instance acquires.
+func (s *Storage) identify() error {
+	if s.owner != "" {
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	instanceId, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	s.hostname = hostname
+	s.owner = fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), instanceId)
+	return nil
+}
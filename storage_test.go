@@ -1,13 +1,22 @@
 package storagefirestore
 
 import (
+	"cloud.google.com/go/firestore"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -60,6 +69,9 @@ func (ts *StorageTS) Test_keyToRef() {
 
 	ref = ts.s.keyToRef(certmagic.KeyBuilder{}.SitePrivateKey("issuer", "domain.com"))
 	ts.Equal(prefix+"certmagic/certificates\\issuer\\domain.com\\domain.com.key", ref.Path)
+
+	ref = ts.s.lockRef(certmagic.KeyBuilder{}.SiteCert("issuer", "domain.com"))
+	ts.Equal(prefix+"certmagic_locks/certificates\\issuer\\domain.com\\domain.com.crt", ref.Path)
 }
 
 func (ts *StorageTS) Test_attemptLock() {
@@ -72,12 +84,7 @@ func (ts *StorageTS) Test_attemptLock() {
 	ts.NoError(replica.setupAfterProvision(ctx))
 	ts.NotNil(replica)
 
-	defer func() {
-		_, err := ts.s.keyToRef(key).Delete(ctx)
-		ts.NoError(err)
-	}()
-
-	// No certificate exists.
+	// No lock exists.
 	ts.Nil(ts.s.locks[key])
 	ts.NoError(ts.s.Lock(ctx, key))
 	ts.NotNil(ts.s.locks[key])
@@ -86,8 +93,11 @@ func (ts *StorageTS) Test_attemptLock() {
 	ts.Error(replica.attemptLock(ctx, key), errAlreadyLocked.Error())
 	ts.Nil(replica.locks[key])
 
-	// The local process can enter the lock it already holds.
-	ts.NoError(ts.s.Lock(ctx, key))
+	// Other goroutines of the local process queue behind the holder.
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	ts.Equal(context.DeadlineExceeded, ts.s.Lock(waitCtx, key))
+	ts.True(errors.Is(ts.s.attemptLock(ctx, key), errAlreadyLocked))
 	ts.NotNil(ts.s.locks[key])
 
 	// The certificate is now unlocked.
@@ -108,6 +118,16 @@ func (ts *StorageTS) Test_attemptLock() {
 	ts.Nil(ts.s.locks[key])
 }
 
+// replicaOf returns a second Storage that shares the suite's backend but
+// none of its local lock state, standing in for another cluster node.
+func replicaOf(ts *StorageTS) *Storage {
+	replica := New()
+	replica.ProjectId = ts.s.ProjectId
+	replica.AesKey = []byte(testKey)
+	ts.Require().NoError(replica.setupAfterProvision(context.Background()))
+	return replica
+}
+
 func (ts *StorageTS) getRandomBytes(n int) []byte {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -179,26 +199,79 @@ func (ts *StorageTS) Test_Crud() {
 	ts.False(ts.s.Exists(key))
 }
 
+// A key that was locked but never stored must read as not existing.
+func (ts *StorageTS) Test_LockOnlyPlaceholder() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "lock-only.com")
+	prefix := certmagic.KeyBuilder{}.CertsSitePrefix("test", "lock-only.com")
+
+	ts.NoError(ts.s.Lock(ctx, key))
+	defer func() {
+		ts.NoError(ts.s.Unlock(key))
+		ts.NoError(ts.s.Delete(key))
+	}()
+
+	ts.False(ts.s.Exists(key))
+
+	_, err := ts.s.Load(key)
+	ts.Error(err)
+	ts.IsType(certmagic.ErrNotExist(err), err)
+
+	_, err = ts.s.Stat(key)
+	ts.Error(err)
+	ts.IsType(certmagic.ErrNotExist(err), err)
+
+	gotKeys, err := ts.s.List(prefix, true)
+	ts.Error(err)
+	ts.Len(gotKeys, 0)
+	ts.IsType(certmagic.ErrNotExist(err), err)
+
+	err = ts.s.Delete(key)
+	ts.Error(err)
+	ts.IsType(certmagic.ErrNotExist(err), err)
+
+	// The lock itself survives the failed delete.
+	ts.Error(replicaOf(ts).attemptLock(ctx, key))
+
+	// Storing into the placeholder makes the key real.
+	expected := ts.getRandomBytes(255)
+	ts.NoError(ts.s.Store(key, expected))
+	ts.True(ts.s.Exists(key))
+	got, err := ts.s.Load(key)
+	ts.NoError(err)
+	ts.Equal(expected, got)
+}
+
 func (ts *StorageTS) Test_UpdateFreshness() {
+	ctx := context.Background()
 	key := certmagic.KeyBuilder{}.SiteCert("test", "test-update-freshness.com")
 
 	expected := ts.getRandomBytes(255)
-	err := ts.s.Store(key, expected)
-	ts.NoError(err)
+	ts.NoError(ts.s.Store(key, expected))
+	ts.NoError(ts.s.Lock(ctx, key))
 
 	recordT0, err := ts.s.loadAndDecrypt(key)
 	ts.NoError(err)
+	lockT0, err := ts.s.loadLock(ctx, key)
+	ts.NoError(err)
 
 	time.Sleep(time.Millisecond * 2)
 
-	ts.NoError(ts.s.updateFreshness(context.Background(), key))
+	ts.NoError(ts.s.updateFreshness(ctx, key, ts.s.locks[key].token))
 
-	recordT1, err := ts.s.loadAndDecrypt(key)
+	lockT1, err := ts.s.loadLock(ctx, key)
 	ts.NoError(err)
+	ts.True(lockT1.RefreshedAt.After(lockT0.RefreshedAt))
+	ts.True(lockT1.ExpiresAt.After(lockT0.ExpiresAt))
+	ts.Equal(lockT0.LockedAt, lockT1.LockedAt)
 
-	ts.True(recordT1.LockedAt.After(recordT0.LockedAt))
+	// The certificate document is left untouched.
+	recordT1, err := ts.s.loadAndDecrypt(key)
+	ts.NoError(err)
+	ts.Equal(recordT0, recordT1)
 
-	ts.s.Delete(key)
+	ts.NoError(ts.s.Unlock(key))
+	ts.NoError(ts.s.Delete(key))
 }
 
 func (ts *StorageTS) Test_keepLockFresh() {
@@ -209,11 +282,12 @@ func (ts *StorageTS) Test_keepLockFresh() {
 
 	key := certmagic.KeyBuilder{}.SiteCert("test", "test-keep-lock-fresh.com")
 
-	expected := ts.getRandomBytes(255)
-	err := ts.s.Store(key, expected)
-	ts.NoError(err)
+	ts.NoError(ts.s.Lock(context.Background(), key))
+	defer func() {
+		ts.NoError(ts.s.Unlock(key))
+	}()
 
-	recordT0, err := ts.s.loadAndDecrypt(key)
+	lockT0, err := ts.s.loadLock(context.Background(), key)
 	ts.NoError(err)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -221,20 +295,885 @@ func (ts *StorageTS) Test_keepLockFresh() {
 		time.Sleep(time.Second * 2)
 		cancel()
 	}()
-	ts.s.keepLockFresh(ctx, key)
+	ts.s.keepLockFresh(ctx, key, ts.s.locks[key])
 
-	recordT1, err := ts.s.loadAndDecrypt(key)
+	lockT1, err := ts.s.loadLock(context.Background(), key)
+	ts.NoError(err)
+
+	ts.True(lockT1.RefreshedAt.After(lockT0.RefreshedAt))
+
+	// No certificate document is created by locking.
+	ts.False(ts.s.Exists(key))
+	_, err = ts.s.keyToRef(key).Get(context.Background())
+	ts.True(IsDocNotFound(err))
+}
+
+func (ts *StorageTS) Test_MaxLockHold() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "max-lock-hold.com")
+	holder := replicaOf(ts)
+	holder.FreshnessSeconds = 1
+	holder.MaxLockHoldSeconds = 2
+
+	ts.NoError(holder.Lock(ctx, key))
+	lost, _ := holder.LockLost(key)
+
+	lock, err := holder.loadLock(ctx, key)
+	ts.NoError(err)
+	ts.Equal(lock.LockedAt.Add(2*time.Second), lock.LeaseUntil)
+
+	// Refreshed but expired once the lease ends, for every node.
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		ts.Fail("lock held past its lease")
+	}
+	ok, err := ts.s.TryLock(ctx, key)
+	ts.NoError(err)
+	ts.True(ok)
+
+	ts.Error(holder.Unlock(key))
+	ts.NoError(ts.s.Unlock(key))
+}
+
+// Locks held at shutdown are released right away.
+func (ts *StorageTS) Test_Cleanup() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "cleanup.com")
+	replica := replicaOf(ts)
+
+	ts.NoError(replica.Lock(ctx, key))
+	lost, _ := replica.LockLost(key)
+
+	ts.NoError(replica.Cleanup())
+	<-lost
+	ts.Empty(replica.locks)
+
+	lock, err := ts.s.loadLock(ctx, key)
+	ts.NoError(err)
+	ts.True(lock.Released)
+
+	ok, err := ts.s.TryLock(ctx, key)
+	ts.NoError(err)
+	ts.True(ok)
+	ts.NoError(ts.s.Unlock(key))
+}
+
+func (ts *StorageTS) Test_LockApp() {
+	ctx := context.Background()
+	storage := replicaOf(ts)
+	storage.LockCollection = DefaultAppLockCollection
+	app := &LockApp{Storage: storage}
+
+	cron, err := app.Namespace("cron")
+	ts.NoError(err)
+	jobs, err := app.Namespace("jobs")
+	ts.NoError(err)
+
+	// The same key in other namespaces, or for certmagic, is another lock.
+	ts.NoError(cron.Lock(ctx, "nightly"))
+	ok, err := jobs.TryLock(ctx, "nightly")
+	ts.NoError(err)
+	ts.True(ok)
+	ok, err = ts.s.TryLock(ctx, "nightly")
+	ts.NoError(err)
+	ts.True(ok)
+
+	ok, err = cron.TryLock(ctx, "nightly")
+	ts.False(ok)
+	ts.True(errors.Is(err, errAlreadyLocked))
+
+	info, err := cron.LockInfo("nightly")
+	ts.NoError(err)
+	ts.Equal("nightly", info.Key)
+	infos, err := cron.ListLocks("")
+	ts.NoError(err)
+	ts.Len(infos, 1)
+
+	ts.NoError(cron.Unlock("nightly"))
+	ts.NoError(jobs.Unlock("nightly"))
+	ts.NoError(ts.s.Unlock("nightly"))
+}
+
+func (ts *StorageTS) Test_Election() {
+	newApp := func() *LockApp {
+		s := replicaOf(ts)
+		s.FreshnessSeconds = 1
+		s.LockCollection = DefaultAppLockCollection
+		return &LockApp{Storage: s, ctx: context.Background(), elections: map[string]*Election{}}
+	}
+	first, second := newApp(), newApp()
+	defer second.Cleanup()
+
+	e1, err := first.Election("maintenance")
+	ts.NoError(err)
+	elected := make(chan context.Context, 1)
+	e1.OnElected(func(term context.Context) { elected <- term })
+	term := <-elected
+	ts.True(e1.IsLeader())
+
+	leader, err := e1.Leader()
+	ts.NoError(err)
+	ts.Equal(first.Storage.owner, leader.Holder)
+
+	// The second node waits its turn.
+	e2, err := second.Election("maintenance")
+	ts.NoError(err)
+	promoted := make(chan struct{})
+	e2.OnElected(func(context.Context) { close(promoted) })
+	time.Sleep(time.Second)
+	ts.False(e2.IsLeader())
+
+	// And takes over when the leader shuts down.
+	ts.NoError(first.Cleanup())
+	<-term.Done()
+	ts.False(e1.IsLeader())
+	select {
+	case <-promoted:
+	case <-time.After(5 * time.Second):
+		ts.Fail("second node not elected")
+	}
+
+	next, err := e2.Leader()
+	ts.NoError(err)
+	ts.Equal(second.Storage.owner, next.Holder)
+	ts.True(next.Term > leader.Term)
+}
+
+func (ts *StorageTS) Test_Cache() {
+	key := certmagic.KeyBuilder{}.SiteCert("test", "cache.com")
+	cached := replicaOf(ts)
+	cached.CacheSize = 10
+	cached.cache = newRecordCache(10, time.Minute)
+	cached.startChangeFeed()
+	defer cached.stopChangeFeed()
+
+	v1 := ts.getRandomBytes(255)
+	ts.NoError(cached.Store(key, v1))
+	loaded, err := cached.Load(key)
+	ts.NoError(err)
+	ts.Equal(v1, loaded)
+
+	hits := testutil.ToFloat64(cacheMetrics.hits)
+	info, err := cached.Stat(key)
+	ts.NoError(err)
+	ts.Equal(int64(255), info.Size)
+	ts.Equal(hits+1, testutil.ToFloat64(cacheMetrics.hits))
+
+	// Writes by other nodes reach the cache through the listener.
+	v2 := ts.getRandomBytes(100)
+	ts.NoError(ts.s.Store(key, v2))
+	time.Sleep(time.Second)
+	loaded, err = cached.Load(key)
+	ts.NoError(err)
+	ts.Equal(v2, loaded)
+
+	ts.NoError(ts.s.Delete(key))
+	time.Sleep(time.Second)
+	_, err = cached.Load(key)
+	ts.Error(err)
+}
+
+func (ts *StorageTS) Test_Preload() {
+	certs := []string{
+		certmagic.KeyBuilder{}.SiteCert("test", "preload-1.com"),
+		certmagic.KeyBuilder{}.SiteCert("test", "preload-2.com"),
+	}
+	other := "preload-other/key"
+	values := map[string][]byte{}
+	for _, key := range append(certs, other) {
+		values[key] = ts.getRandomBytes(64)
+		ts.NoError(ts.s.Store(key, values[key]))
+	}
+
+	warm := New()
+	warm.ProjectId = ts.s.ProjectId
+	warm.AesKey = []byte(testKey)
+	warm.CacheSize = 10
+	warm.Preload = []string{"certificates"}
+	ts.NoError(warm.setupAfterProvision(context.Background()))
+	defer warm.stopChangeFeed()
+
+	for _, key := range certs {
+		cached, found := warm.cache.get(key)
+		ts.True(found, key)
+		if found {
+			ts.Equal(values[key], cached.Raw)
+		}
+	}
+	_, found := warm.cache.get(other)
+	ts.False(found)
+}
+
+func (ts *StorageTS) Test_ChangeFeed() {
+	key := certmagic.KeyBuilder{}.SiteCert("test", "change-feed.com")
+	watcher := replicaOf(ts)
+	events := make(chan ChangeEvent, 10)
+	watcher.OnChange(func(ev ChangeEvent) {
+		if ev.Key == key {
+			events <- ev
+		}
+	})
+	defer watcher.stopChangeFeed()
+	time.Sleep(time.Second)
+
+	next := func() ChangeEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			ts.FailNow("no change event")
+			return ChangeEvent{}
+		}
+	}
+
+	ts.NoError(ts.s.Store(key, ts.getRandomBytes(10)))
+	ts.Equal(KeyCreated, next().Type)
+	ts.NoError(ts.s.Store(key, ts.getRandomBytes(10)))
+	ts.Equal(KeyUpdated, next().Type)
+	ts.NoError(ts.s.Delete(key))
+	ts.Equal(KeyDeleted, next().Type)
+}
+
+// Reads fall back to the local mirror when Firestore fails.
+func (ts *StorageTS) Test_Mirror() {
+	key := certmagic.KeyBuilder{}.SiteCert("test", "mirror.com")
+	dir, err := ioutil.TempDir("", "mirror")
+	ts.NoError(err)
+	defer os.RemoveAll(dir)
+
+	mirrored := replicaOf(ts)
+	mirrored.MirrorDir = dir
+	value := ts.getRandomBytes(64)
+	ts.NoError(mirrored.Store(key, value))
+
+	// A client of its own, so closing it doesn't affect the others.
+	client, err := firestore.NewClient(context.Background(), ts.s.ProjectId)
+	ts.NoError(err)
+	mirrored.client = client
+	ts.NoError(client.Close())
+
+	loaded, err := mirrored.Load(key)
+	ts.NoError(err)
+	ts.Equal(value, loaded)
+	ts.True(mirrored.Exists(key))
+	info, err := mirrored.Stat(key)
+	ts.NoError(err)
+	ts.Equal(int64(64), info.Size)
+
+	// Keys that were never mirrored still fail.
+	_, err = mirrored.Load(key + ".missing")
+	ts.Error(err)
+
+	ts.NoError(ts.s.Delete(key))
+}
+
+// Queued writes are replayed unless the record changed since this instance
+// last saw it.
+func (ts *StorageTS) Test_WriteQueue() {
+	keys := certmagic.KeyBuilder{}
+	replayed, superseded := keys.SiteCert("test", "queue-replayed.com"), keys.SiteCert("test", "queue-superseded.com")
+	updated := keys.SiteCert("test", "queue-updated.com")
+	dir, err := ioutil.TempDir("", "write-queue")
+	ts.NoError(err)
+	defer os.RemoveAll(dir)
+
+	queued := replicaOf(ts)
+	queued.WriteQueueDir = dir
+	ts.NoError(queued.acquireWriteQueue())
+	defer queued.releaseWriteQueue()
+
+	enqueue := func(key string, value []byte) {
+		ciphertext, err := queued.encrypt(value)
+		ts.NoError(err)
+		w := &queuedWrite{Key: key, Raw: ciphertext, Size: int64(len(value)), QueuedAt: UTCNow()}
+		ts.NoError(queued.enqueueWrite(w, errors.New("unavailable")))
+	}
+
+	// Seen by the queuing instance before its write.
+	ts.NoError(ts.s.Store(updated, ts.getRandomBytes(10)))
+	_, err = queued.Load(updated)
+	ts.NoError(err)
+
+	v1 := ts.getRandomBytes(10)
+	enqueue(replayed, v1)
+	enqueue(superseded, ts.getRandomBytes(10))
+	v2 := ts.getRandomBytes(10)
+	ts.NoError(ts.s.Store(superseded, v2))
+	v3 := ts.getRandomBytes(10)
+	enqueue(updated, v3)
+
+	time.Sleep(writeQueueRetryInterval + time.Second)
+	ts.Empty(queued.queue.writes)
+
+	loaded, err := ts.s.Load(replayed)
+	ts.NoError(err)
+	ts.Equal(v1, loaded)
+	loaded, err = ts.s.Load(superseded)
+	ts.NoError(err)
+	ts.Equal(v2, loaded)
+	loaded, err = ts.s.Load(updated)
+	ts.NoError(err)
+	ts.Equal(v3, loaded)
+
+	ts.NoError(ts.s.Delete(replayed))
+	ts.NoError(ts.s.Delete(superseded))
+	ts.NoError(ts.s.Delete(updated))
+}
+
+// Writes made once Firestore is back replace the queued ones right away.
+func (ts *StorageTS) Test_WriteQueueStore() {
+	key := certmagic.KeyBuilder{}.SiteCert("test", "queue-store.com")
+	dir, err := ioutil.TempDir("", "write-queue")
+	ts.NoError(err)
+	defer os.RemoveAll(dir)
+
+	queued := replicaOf(ts)
+	queued.WriteQueueDir = dir
+	ts.NoError(queued.acquireWriteQueue())
+	defer queued.releaseWriteQueue()
+
+	ciphertext, err := queued.encrypt(ts.getRandomBytes(10))
+	ts.NoError(err)
+	ts.NoError(queued.enqueueWrite(&queuedWrite{Key: key, Raw: ciphertext, Size: 10, QueuedAt: UTCNow()}, errors.New("unavailable")))
+
+	value := ts.getRandomBytes(10)
+	ts.NoError(queued.Store(key, value))
+	ts.Nil(queued.queue.latest(key))
+	loaded, err := queued.Load(key)
+	ts.NoError(err)
+	ts.Equal(value, loaded)
+
+	ts.NoError(ts.s.Delete(key))
+}
+
+// Keys only in the write queue can be deleted.
+func (ts *StorageTS) Test_WriteQueueDelete() {
+	keys := []string{
+		certmagic.KeyBuilder{}.SiteCert("test", "queue-delete.com"),
+		certmagic.KeyBuilder{}.SiteCert("test", "queue-delete-many.com"),
+	}
+	dir, err := ioutil.TempDir("", "write-queue")
+	ts.NoError(err)
+	defer os.RemoveAll(dir)
+
+	queued := replicaOf(ts)
+	queued.WriteQueueDir = dir
+	ts.NoError(queued.acquireWriteQueue())
+	defer queued.releaseWriteQueue()
+
+	for _, key := range keys {
+		ciphertext, err := queued.encrypt(ts.getRandomBytes(10))
+		ts.NoError(err)
+		ts.NoError(queued.enqueueWrite(&queuedWrite{Key: key, Raw: ciphertext, Size: 10, QueuedAt: UTCNow()}, errors.New("unavailable")))
+		ts.True(queued.Exists(key))
+	}
+
+	ts.NoError(queued.Delete(keys[0]))
+	ts.NoError(queued.DeleteMany(keys[1:]))
+	for _, key := range keys {
+		ts.False(queued.Exists(key))
+		ts.Nil(queued.queue.latest(key))
+	}
+}
+
+func (ts *StorageTS) Test_BatchOps() {
+	// More than fits in one batch.
+	values := map[string][]byte{}
+	var keys []string
+	for i := 0; i <= maxBatchOps; i++ {
+		key := certmagic.KeyBuilder{}.SiteCert("test", fmt.Sprintf("batch-%d.com", i))
+		values[key] = ts.getRandomBytes(32)
+		keys = append(keys, key)
+	}
+	ts.NoError(ts.s.StoreMany(values))
+
+	// Updates existing records, too.
+	values[keys[0]] = ts.getRandomBytes(32)
+	ts.NoError(ts.s.StoreMany(map[string][]byte{keys[0]: values[keys[0]]}))
+
+	missing := certmagic.KeyBuilder{}.SiteCert("test", "batch-missing.com")
+	loaded, err := ts.s.LoadMany(append(keys, missing))
+	ts.Equal(values, loaded)
+	var keyErrs KeyErrors
+	ts.True(errors.As(err, &keyErrs))
+	ts.Len(keyErrs, 1)
+	ts.Contains(keyErrs[missing].Error(), "not found")
+
+	err = ts.s.DeleteMany(append(keys, missing))
+	ts.True(errors.As(err, &keyErrs))
+	ts.Len(keyErrs, 1)
+	ts.Contains(keyErrs, missing)
+	for _, key := range keys {
+		ts.False(ts.s.Exists(key))
+	}
+}
+
+// Batches failing because a record changed since it was read are written
+// one by one.
+func (ts *StorageTS) Test_StoreManyFallback() {
+	ctx := context.Background()
+	keys := []string{
+		certmagic.KeyBuilder{}.SiteCert("test", "batch-fallback-a.com"),
+		certmagic.KeyBuilder{}.SiteCert("test", "batch-fallback-b.com"),
+	}
+	ts.NoError(ts.s.Store(keys[0], ts.getRandomBytes(32)))
+
+	values := map[string][]byte{}
+	var writes []*queuedWrite
+	for _, key := range keys {
+		values[key] = ts.getRandomBytes(32)
+		ciphertext, err := ts.s.encrypt(values[key])
+		ts.NoError(err)
+		writes = append(writes, &queuedWrite{Key: key, Raw: ciphertext, Size: 32, QueuedAt: UTCNow()})
+	}
+
+	docs, err := ts.s.getAll(ctx, keys)
+	ts.NoError(err)
+	ts.NoError(ts.s.Store(keys[0], ts.getRandomBytes(32)))
+	err = ts.s.storeBatch(ctx, writes, docs)
+	ts.Error(err)
+	ts.False(isUnavailable(err))
+
+	errs := KeyErrors{}
+	ts.s.settleStores(writes, err, errs)
+	ts.Empty(errs)
+	loaded, err := ts.s.LoadMany(keys)
+	ts.NoError(err)
+	ts.Equal(values, loaded)
+
+	ts.NoError(ts.s.DeleteMany(keys))
+}
+
+// Stat doesn't decrypt records with a stored size.
+func (ts *StorageTS) Test_StatSize() {
+	key := certmagic.KeyBuilder{}.SiteCert("test", "stat-size.com")
+	ts.NoError(ts.s.Store(key, ts.getRandomBytes(123)))
+
+	noKey := replicaOf(ts)
+	noKey.AesKey = nil
+	info, err := noKey.Stat(key)
+	ts.NoError(err)
+	ts.Equal(int64(123), info.Size)
+
+	// Empty values have a stored size too.
+	ts.NoError(ts.s.Store(key, []byte{}))
+	info, err = noKey.Stat(key)
+	ts.NoError(err)
+	ts.Equal(int64(0), info.Size)
+
+	ts.NoError(ts.s.Delete(key))
+}
+
+func (ts *StorageTS) Test_LockOwnership() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "lock-ownership.com")
+	replica := replicaOf(ts)
+
+	ts.NoError(ts.s.Lock(ctx, key))
+	token := ts.s.locks[key].token
+
+	lock, err := ts.s.loadLock(ctx, key)
+	ts.NoError(err)
+	ts.Equal(ts.s.owner, lock.Owner)
+	ts.Equal(ts.s.hostname, lock.Hostname)
+	ts.Equal(token, lock.Token)
+
+	// Nobody else can refresh it.
+	ts.Equal(errLockNotOwned, replica.updateFreshness(ctx, key, "not-the-token"))
+
+	// Simulate the lock going stale, e.g. a paused process.
+	staleAt := UTCNow().Add(-time.Hour)
+	_, err = ts.s.lockRef(key).Update(ctx, []firestore.Update{
+		{Path: "refreshedAt", Value: staleAt},
+		{Path: "expiresAt", Value: ts.s.expiresAt(staleAt)},
+	})
+	ts.NoError(err)
+
+	// The replica takes it over.
+	ts.NoError(replica.attemptLock(ctx, key))
+
+	// The previous holder learns it lost the lock on its next refresh.
+	lost, found := ts.s.LockLost(key)
+	ts.True(found)
+	ts.s.keepLockFresh(context.Background(), key, ts.s.locks[key])
+	select {
+	case <-lost:
+	default:
+		ts.Fail("lock loss was not signaled")
+	}
+
+	// And can neither refresh nor release it.
+	ts.Equal(errLockNotOwned, ts.s.updateFreshness(ctx, key, token))
+	err = ts.s.Unlock(key)
+	ts.Error(err)
+	ts.True(errors.Is(err, errLockNotOwned))
+
+	lock, err = ts.s.loadLock(ctx, key)
+	ts.NoError(err)
+	ts.Equal(replica.owner, lock.Owner)
+
+	ts.NoError(replica.Unlock(key))
+	lock, err = ts.s.loadLock(ctx, key)
+	ts.NoError(err)
+	ts.True(lock.Released)
+
+	// Released locks can be acquired right away.
+	ts.NoError(ts.s.attemptLock(ctx, key))
+	ts.NoError(ts.s.Unlock(key))
+}
+
+// Waiters are woken by the lock listener rather than by polling.
+func (ts *StorageTS) Test_LockWaitsForRelease() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "lock-wait.com")
+	replica := replicaOf(ts)
+	replica.MinPollSeconds = 30
+	replica.MaxPollSeconds = 30
+
+	ts.NoError(ts.s.Lock(ctx, key))
+
+	acquired := make(chan time.Time)
+	go func() {
+		ts.NoError(replica.Lock(ctx, key))
+		acquired <- time.Now()
+	}()
+
+	time.Sleep(time.Second)
+	released := time.Now()
+	ts.NoError(ts.s.Unlock(key))
+
+	select {
+	case at := <-acquired:
+		ts.True(at.Sub(released) < 5*time.Second)
+	case <-time.After(10 * time.Second):
+		ts.Fail("lock was not acquired after release")
+	}
+
+	ts.NoError(replica.Unlock(key))
+}
+
+func (ts *StorageTS) Test_LockWithTimeoutStaysFresh() {
+	ctx := context.Background()
+	key := "lock-with-timeout-fresh"
+	holder := replicaOf(ts)
+	holder.FreshnessSeconds = 1
+	other := replicaOf(ts)
+	other.FreshnessSeconds = 1
+
+	ts.NoError(holder.LockWithTimeout(ctx, key, time.Second))
+	lost, _ := holder.LockLost(key)
+
+	// The timeout is long over, but the lock is still refreshed.
+	time.Sleep(3 * time.Duration(holder.FreshnessSeconds) * time.Second)
+	ok, err := other.TryLock(ctx, key)
+	ts.False(ok)
+	ts.True(errors.Is(err, errAlreadyLocked))
+	select {
+	case <-lost:
+		ts.Fail("lock was lost")
+	default:
+	}
+
+	ts.NoError(holder.Unlock(key))
+}
+
+func (ts *StorageTS) Test_TryLock() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "try-lock.com")
+	replica := replicaOf(ts)
+
+	ok, err := ts.s.TryLock(ctx, key)
+	ts.NoError(err)
+	ts.True(ok)
+
+	ok, err = replica.TryLock(ctx, key)
+	ts.False(ok)
+	var locked *ErrLocked
+	ts.True(errors.As(err, &locked))
+	ts.Equal(key, locked.Key)
+	ts.Equal(ts.s.owner, locked.Holder)
+	ts.True(locked.Age >= 0)
+
+	start := time.Now()
+	err = replica.LockWithTimeout(ctx, key, time.Second)
+	ts.True(time.Since(start) >= time.Second)
+	ts.True(errors.As(err, &locked))
+	ts.Equal(ts.s.owner, locked.Holder)
+
+	ts.NoError(ts.s.Unlock(key))
+
+	ts.NoError(replica.LockWithTimeout(ctx, key, time.Second))
+	ts.NoError(replica.Unlock(key))
+}
+
+func (ts *StorageTS) Test_LockInfo() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "lock-info.com")
+	prefix := certmagic.KeyBuilder{}.CertsSitePrefix("test", "lock-info.com")
+
+	_, err := ts.s.LockInfo(key)
+	ts.True(errors.Is(err, ErrLockNotFound))
+
+	ts.NoError(ts.s.Lock(ctx, key))
+
+	info, err := ts.s.LockInfo(key)
+	ts.NoError(err)
+	ts.Equal(key, info.Key)
+	ts.Equal(ts.s.owner, info.Holder)
+	ts.Equal(ts.s.hostname, info.Hostname)
+	ts.False(info.AcquiredAt.IsZero())
+	ts.False(info.RefreshedAt.Before(info.AcquiredAt))
+	ts.False(info.Stale)
+
+	infos, err := ts.s.ListLocks(prefix)
+	ts.NoError(err)
+	ts.Len(infos, 1)
+	ts.Equal(info, infos[0])
+
+	// And through the admin API.
+	registerStorage(ts.s)
+	defer unregisterStorage(ts.s)
+
+	a := &AdminAPI{}
+	w := httptest.NewRecorder()
+	ts.NoError(a.handleLocks(w, httptest.NewRequest(http.MethodGet, "/firestore/locks?prefix="+prefix, nil)))
+	var listed []*LockInfo
+	ts.NoError(json.Unmarshal(w.Body.Bytes(), &listed))
+	ts.Len(listed, 1)
+	ts.Equal(key, listed[0].Key)
+
+	w = httptest.NewRecorder()
+	ts.NoError(a.handleLocks(w, httptest.NewRequest(http.MethodGet, "/firestore/locks?key="+key, nil)))
+	var described LockInfo
+	ts.NoError(json.Unmarshal(w.Body.Bytes(), &described))
+	ts.Equal(ts.s.owner, described.Holder)
+
+	ts.NoError(ts.s.Unlock(key))
+
+	// Released locks are gone.
+	_, err = ts.s.LockInfo(key)
+	ts.True(errors.Is(err, ErrLockNotFound))
+	infos, err = ts.s.ListLocks(prefix)
+	ts.NoError(err)
+	ts.Len(infos, 0)
+
+	err = a.handleLocks(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/firestore/locks?key="+key, nil))
+	ts.Equal(http.StatusNotFound, err.(caddy.APIError).Code)
+}
+
+func (ts *StorageTS) Test_ForceUnlock() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "force-unlock.com")
+	replica := replicaOf(ts)
+
+	_, err := replica.ForceUnlock(key, "operator", "testing", true)
+	ts.True(errors.Is(err, ErrLockNotFound))
+
+	ts.NoError(ts.s.Lock(ctx, key))
+	lost, _ := ts.s.LockLost(key)
+
+	// Too young.
+	_, err = replica.ForceUnlock(key, "operator", "testing", false)
+	ts.True(errors.Is(err, ErrLockTooYoung))
+
+	info, err := replica.ForceUnlock(key, "operator", "node died", true)
+	ts.NoError(err)
+	ts.Equal(ts.s.owner, info.Holder)
+
+	lock, err := ts.s.loadLock(ctx, key)
+	ts.NoError(err)
+	ts.True(lock.Released)
+	ts.Equal("operator", lock.ForcedBy)
+	ts.Equal("node died", lock.ForcedReason)
+	ts.False(lock.ForcedAt.IsZero())
+
+	// The lock is free, and the old holder learns it lost it.
+	ok, err := replica.TryLock(ctx, key)
+	ts.NoError(err)
+	ts.True(ok)
+
+	ts.s.keepLockFresh(context.Background(), key, ts.s.locks[key])
+	select {
+	case <-lost:
+	default:
+		ts.Fail("lock loss was not signaled")
+	}
+	ts.Error(ts.s.Unlock(key))
+	ts.NoError(replica.Unlock(key))
+}
+
+// Two goroutines of the same process never hold a lock together.
+func (ts *StorageTS) Test_LockLocalExclusion() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "lock-local-exclusion.com")
+
+	inside := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.NoError(ts.s.Lock(ctx, key))
+			inside++
+			ts.Equal(1, inside)
+			time.Sleep(100 * time.Millisecond)
+			inside--
+			ts.NoError(ts.s.Unlock(key))
+		}()
+	}
+	wg.Wait()
+
+	ts.Nil(ts.s.locks[key])
+}
+
+// In queue mode, waiters get the lock in the order they queued.
+func (ts *StorageTS) Test_LockQueue() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "lock-queue.com")
+	first, second := replicaOf(ts), replicaOf(ts)
+	first.LockQueue, second.LockQueue = true, true
+
+	ts.NoError(ts.s.Lock(ctx, key))
+
+	// A dead waiter's ticket ahead of everyone is reaped.
+	_, err := ts.s.ticketRef(key, 1).Create(ctx, map[string]interface{}{
+		"owner":       "dead",
+		"seq":         1,
+		"refreshedAt": UTCNow().Add(-time.Hour),
+	})
 	ts.NoError(err)
 
-	ts.True(recordT1.LockedAt.After(recordT0.LockedAt))
+	order := make(chan *Storage, 2)
+	acquire := func(s *Storage) {
+		ts.NoError(s.Lock(ctx, key))
+		order <- s
+		time.Sleep(100 * time.Millisecond)
+		ts.NoError(s.Unlock(key))
+	}
+	go acquire(first)
+	time.Sleep(time.Second)
+	go acquire(second)
+	time.Sleep(time.Second)
+
+	ts.NoError(ts.s.Unlock(key))
+	ts.Equal(first, <-order)
+	ts.Equal(second, <-order)
+
+	// The queue is empty again.
+	docs, err := ts.s.lockRef(key).Collection(ticketCollection).Documents(ctx).GetAll()
+	ts.NoError(err)
+	ts.Len(docs, 0)
+}
+
+func (ts *StorageTS) Test_refreshTicket() {
+	ctx := context.Background()
+	key := "refresh-ticket"
+	ticket := &LockTicket{Seq: 1}
+
+	err := ts.s.refreshTicket(ctx, key, ticket)
+	ts.True(IsDocNotFound(err))
+
+	_, err = ts.s.ticketRef(key, 1).Create(ctx, map[string]interface{}{"seq": 1})
+	ts.NoError(err)
+	ts.NoError(ts.s.refreshTicket(ctx, key, ticket))
 
-	// Context already cancelled.
-	ts.s.keepLockFresh(ctx, key)
-	recordT2, err := ts.s.loadAndDecrypt(key)
+	// Both times come from the server.
+	doc, err := ts.s.ticketRef(key, 1).Get(ctx)
+	ts.NoError(err)
+	var refreshed LockTicket
+	ts.NoError(doc.DataTo(&refreshed))
+	ts.WithinDuration(refreshed.RefreshedAt.Add(ts.s.staleAfter()), refreshed.ExpiresAt, time.Second)
+
+	_, err = ts.s.ticketRef(key, 1).Delete(ctx)
+	ts.NoError(err)
+}
+
+func (ts *StorageTS) Test_Fencing() {
+	ctx := context.Background()
+	key := certmagic.KeyBuilder{}.SiteCert("test", "fencing.com")
+	replica := replicaOf(ts)
+
+	ts.NoError(ts.s.Lock(ctx, key))
+	fence, found := ts.s.Fence(key)
+	ts.True(found)
+	ts.True(fence > 0)
+
+	ts.NoError(ts.s.Store(key, ts.getRandomBytes(255)))
+	record, err := ts.s.loadAndDecrypt(key)
+	ts.NoError(err)
+	ts.Equal(fence, record.Fence)
+
+	// Simulate the holder pausing long enough for its lock to go stale.
+	staleAt := UTCNow().Add(-time.Hour)
+	_, err = ts.s.lockRef(key).Update(ctx, []firestore.Update{
+		{Path: "refreshedAt", Value: staleAt},
+	})
+	ts.NoError(err)
+
+	ts.NoError(replica.attemptLock(ctx, key))
+	replicaFence, _ := replica.Fence(key)
+	ts.Equal(fence+1, replicaFence)
+
+	// The paused holder resumes, but its writes are fenced off.
+	ts.Equal(ErrStaleFence, ts.s.Store(key, ts.getRandomBytes(255)))
+	ts.Equal(ErrStaleFence, ts.s.Delete(key))
+	ts.Error(ts.s.Unlock(key))
+
+	expected := ts.getRandomBytes(255)
+	ts.NoError(replica.Store(key, expected))
+	got, err := replica.Load(key)
+	ts.NoError(err)
+	ts.Equal(expected, got)
+	ts.NoError(replica.Unlock(key))
+
+	// Fences keep increasing even if the TTL policy removed the lock.
+	_, err = ts.s.lockRef(key).Delete(ctx)
+	ts.NoError(err)
+	ts.NoError(ts.s.attemptLock(ctx, key))
+	fence, _ = ts.s.Fence(key)
+	ts.Equal(replicaFence+1, fence)
+
+	ts.NoError(ts.s.Delete(key))
+	ts.NoError(ts.s.Unlock(key))
+}
+
+func (ts *StorageTS) Test_FencingCertmagic() {
+	ctx := context.Background()
+	issuer := "acme-v02.api.letsencrypt.org-directory"
+	lock := fmt.Sprintf("cert_acme_%s_%s", "fencing-certmagic.com", issuer)
+	key := certmagic.KeyBuilder{}.SiteCert(issuer, "fencing-certmagic.com")
+	replica := replicaOf(ts)
+
+	// certmagic stores the certificate under its issue lock.
+	ts.NoError(ts.s.Lock(ctx, lock))
+	fence, _ := ts.s.Fence(lock)
+	ts.NoError(ts.s.Store(key, ts.getRandomBytes(255)))
+	record, err := ts.s.loadAndDecrypt(key)
+	ts.NoError(err)
+	ts.Equal(fence, record.Fence)
+
+	// The holder pauses, its lock goes stale and is taken over.
+	_, err = ts.s.lockRef(lock).Update(ctx, []firestore.Update{
+		{Path: "refreshedAt", Value: UTCNow().Add(-time.Hour)},
+	})
+	ts.NoError(err)
+	ts.NoError(replica.attemptLock(ctx, lock))
+	ts.Equal(ErrStaleFence, ts.s.Store(key, ts.getRandomBytes(255)))
+	ts.Error(ts.s.Unlock(lock))
+	replicaFence, _ := replica.Fence(lock)
+	ts.NoError(replica.Unlock(lock))
+
+	// There is no record named after the lock, but fences keep increasing
+	// after the TTL policy removed it.
+	_, err = ts.s.lockRef(lock).Delete(ctx)
 	ts.NoError(err)
-	ts.Equal(recordT1, recordT2)
+	ts.NoError(replica.attemptLock(ctx, lock))
+	next, _ := replica.Fence(lock)
+	ts.True(next > replicaFence)
 
-	ts.s.Delete(key)
+	ts.NoError(replica.Delete(key))
+	ts.NoError(replica.Unlock(lock))
 }
 
 func (ts *StorageTS) Test_ListNonRecursive() {
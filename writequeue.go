@@ -0,0 +1,371 @@
+package storagefirestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A durable write-behind queue for Store.
+//
+// With write_queue_dir set, a Store that fails because Firestore is
+// unavailable is saved to a file there (encrypted like in Firestore) and
+// reported as successful. The queue is replayed in order in the background
+// once Firestore answers again. A queued write is dropped as a conflict if
+// the record changed (by any node) since this instance last read or wrote
+// it, or if a newer lock holder fenced it off. Changes are told by the
+// record's update time on the Firestore server, so clocks don't matter: the
+// update time this instance last saw of every record is kept for that.
+// A newer write of a key replaces its queued writes. Reads of this instance
+// see queued writes.
+//
+// Queues are shared by every config using the same directory, so a
+// `caddy reload` doesn't start a second replayer.
+
+// How often the queue is replayed while Firestore is down.
+const writeQueueRetryInterval = 5 * time.Second
+
+// errWriteConflict is the reason for dropping a queued write of a record
+// that changed since.
+var errWriteConflict = errors.New("record changed since the write was queued")
+
+var writeQueues = caddy.NewUsagePool()
+
+// queuedWrite is a Store waiting to be replayed, as saved to disk.
+type queuedWrite struct {
+	Seq int64  `json:"seq"`
+	Key string `json:"key"`
+
+	// Ciphertext, as it will be stored in Firestore.
+	Raw   []byte `json:"raw"`
+	Size  int64  `json:"size"`
+	Fence int64  `json:"fence"`
+
+	// The lock Fence was taken from.
+	FenceLock string `json:"fence_lock,omitempty"`
+
+	// Server update time of the record the write replaces, zero if it
+	// didn't exist or this instance never saw it. The write is only
+	// replayed over that version.
+	UpdateTime time.Time `json:"update_time"`
+
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// fenceLock is the lock w is fenced by. Writes queued by older versions
+// were only fenced by the lock of the same name.
+func (w *queuedWrite) fenceLock() string {
+	if w.FenceLock == "" {
+		return w.Key
+	}
+	return w.FenceLock
+}
+
+// writeQueue holds the queued writes of a directory in order.
+type writeQueue struct {
+	dir string
+
+	m       sync.Mutex
+	writes  []*queuedWrite
+	nextSeq int64
+
+	// The Storage replaying the writes: the latest one to share the queue.
+	storage *Storage
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func (q *writeQueue) Destruct() error {
+	q.stop()
+	<-q.done
+	return nil
+}
+
+// acquireWriteQueue loads the queue in WriteQueueDir, and makes this
+// instance replay it.
+func (s *Storage) acquireWriteQueue() error {
+	value, _, err := writeQueues.LoadOrNew(s.WriteQueueDir, func() (caddy.Destructor, error) {
+		return openWriteQueue(s.WriteQueueDir)
+	})
+	if err != nil {
+		return err
+	}
+
+	q := value.(*writeQueue)
+	q.m.Lock()
+	q.storage = s
+	q.m.Unlock()
+	s.queue = q
+
+	q.start()
+	return nil
+}
+
+// releaseWriteQueue gives up this instance's share of its queue.
+func (s *Storage) releaseWriteQueue() error {
+	if s.queue == nil {
+		return nil
+	}
+
+	q := s.queue
+	q.m.Lock()
+	if q.storage == s {
+		q.storage = nil
+	}
+	q.m.Unlock()
+
+	s.queue = nil
+	_, err := writeQueues.Delete(q.dir)
+	return err
+}
+
+func openWriteQueue(dir string) (*writeQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &writeQueue{dir: dir}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var w queuedWrite
+		if err := json.Unmarshal(b, &w); err != nil {
+			return nil, fmt.Errorf("corrupt queued write %s: %w", name, err)
+		}
+		q.writes = append(q.writes, &w)
+		if w.Seq >= q.nextSeq {
+			q.nextSeq = w.Seq + 1
+		}
+	}
+
+	sort.Slice(q.writes, func(i, j int) bool {
+		return q.writes[i].Seq < q.writes[j].Seq
+	})
+	writeQueueMetrics.depth.Add(float64(len(q.writes)))
+	return q, nil
+}
+
+// start runs the replayer unless it is running.
+func (q *writeQueue) start() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.stop != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, q.stop = context.WithCancel(context.Background())
+	q.done = make(chan struct{})
+	go func() {
+		defer close(q.done)
+		q.run(ctx)
+	}()
+}
+
+// enqueueWrite saves w, which failed with cause, for replay, in place of
+// the writes of the same key queued before.
+func (s *Storage) enqueueWrite(w *queuedWrite, cause error) error {
+	q := s.queue
+	w.UpdateTime = s.knownVersion(w.Key)
+
+	q.m.Lock()
+	w.Seq = q.nextSeq
+	q.nextSeq++
+	b, err := json.Marshal(w)
+	if err == nil {
+		err = writeFileAtomic(q.path(w), b)
+	}
+	if err == nil {
+		q.writes = append(q.writes, w)
+	}
+	q.m.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("unable to queue write of %s after %v: %w", w.Key, cause, err)
+	}
+
+	// Replayed first, the older writes would change the record and w would
+	// be dropped as a conflict.
+	q.remove(func(queued *queuedWrite) bool { return queued.Key == w.Key && queued != w })
+	writeQueueMetrics.depth.Inc()
+	s.logger.Warnf("queued write of %s for replay: %v", w.Key, cause)
+	return nil
+}
+
+// queuedRecord returns the latest queued write of key, decrypted.
+func (s *Storage) queuedRecord(key string) (*Record, bool, error) {
+	if s.queue == nil {
+		return nil, false, nil
+	}
+
+	w := s.queue.latest(key)
+	if w == nil {
+		return nil, false, nil
+	}
+
+	plaintext, err := s.decrypt(w.Raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return &Record{
+		Raw:       plaintext,
+		CreatedAt: w.QueuedAt,
+		UpdatedAt: w.QueuedAt,
+		Fence:     w.Fence,
+		Size:      w.Size,
+	}, true, nil
+}
+
+func (q *writeQueue) latest(key string) *queuedWrite {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i := len(q.writes) - 1; i >= 0; i-- {
+		if q.writes[i].Key == key {
+			return q.writes[i]
+		}
+	}
+	return nil
+}
+
+func (q *writeQueue) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		q.replay(ctx)
+		timer.Reset(writeQueueRetryInterval)
+	}
+}
+
+// replay writes the queued writes in order, until one fails because
+// Firestore is still unavailable.
+func (q *writeQueue) replay(ctx context.Context) {
+	for ctx.Err() == nil {
+		q.m.Lock()
+		s := q.storage
+		var w *queuedWrite
+		if len(q.writes) > 0 {
+			w = q.writes[0]
+		}
+		q.m.Unlock()
+
+		if w == nil || s == nil {
+			return
+		}
+
+		err := s.storeEncrypted(ctx, w, true)
+		switch {
+		case err == nil:
+			writeQueueMetrics.replayed.Inc()
+			s.logger.Infof("replayed queued write of %s", w.Key)
+		case isUnavailable(err) || ctx.Err() != nil:
+			return
+		case errors.Is(err, errWriteConflict), errors.Is(err, ErrStaleFence):
+			writeQueueMetrics.conflicts.Inc()
+			s.logger.Warnf("dropped queued write of %s from %s: %v", w.Key, w.QueuedAt, err)
+		default:
+			writeQueueMetrics.failures.Inc()
+			s.logger.Errorf("dropped queued write of %s from %s: %v", w.Key, w.QueuedAt, err)
+		}
+
+		s.cache.invalidate(w.Key)
+		q.remove(func(queued *queuedWrite) bool { return queued == w })
+	}
+}
+
+// discard drops the queued writes of key, which was deleted.
+func (q *writeQueue) discard(key string) {
+	q.remove(func(w *queuedWrite) bool { return w.Key == key })
+}
+
+// remove drops the queued writes matching drop.
+func (q *writeQueue) remove(drop func(*queuedWrite) bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	kept := q.writes[:0]
+	for _, w := range q.writes {
+		if !drop(w) {
+			kept = append(kept, w)
+			continue
+		}
+
+		// Should the file survive, a replay after a restart is dropped
+		// as a conflict or recreates a deleted key.
+		if err := os.Remove(q.path(w)); err != nil && !os.IsNotExist(err) && q.storage != nil {
+			q.storage.logger.Errorf("unable to remove queued write of %s: %v", w.Key, err)
+		}
+		writeQueueMetrics.depth.Dec()
+	}
+	q.writes = kept
+}
+
+func (q *writeQueue) path(w *queuedWrite) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", w.Seq))
+}
+
+// sawVersion records updateTime as the server update time of key, read
+// from or written to Firestore, for the writes queued later. A zero time
+// means the record doesn't exist or its version is unknown.
+func (s *Storage) sawVersion(key string, updateTime time.Time) {
+	if s.queue == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if updateTime.IsZero() {
+		delete(s.versions, key)
+		return
+	}
+	if s.versions == nil {
+		s.versions = map[string]time.Time{}
+	}
+	s.versions[key] = updateTime
+}
+
+// knownVersion returns the server update time of key this instance last
+// saw, or zero.
+func (s *Storage) knownVersion(key string) time.Time {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.versions[key]
+}
+
+// readVersion reads back the update time of key after this instance wrote
+// it, as transactions don't return it.
+func (s *Storage) readVersion(key string) {
+	if s.queue == nil {
+		return
+	}
+
+	doc, err := s.getDoc(key)
+	if err != nil {
+		s.sawVersion(key, time.Time{})
+		return
+	}
+	s.sawVersion(key, doc.UpdateTime)
+}
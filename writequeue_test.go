@@ -0,0 +1,133 @@
+package storagefirestore
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newQueueStorage(t *testing.T) (*Storage, func()) {
+	dir, err := ioutil.TempDir("", "write-queue")
+	assert.NoError(t, err)
+
+	s := New()
+	s.AesKey = []byte(testKey)
+	s.WriteQueueDir = dir
+	s.logger = zap.NewNop().Sugar()
+
+	// Not started: there's no Firestore to replay to.
+	s.queue, err = openWriteQueue(dir)
+	assert.NoError(t, err)
+	s.queue.storage = s
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func (s *Storage) queueTestWrite(t *testing.T, key, value string) {
+	ciphertext, err := s.encrypt([]byte(value))
+	assert.NoError(t, err)
+	w := &queuedWrite{Key: key, Raw: ciphertext, Size: int64(len(value)), QueuedAt: UTCNow()}
+	assert.NoError(t, s.enqueueWrite(w, errors.New("unavailable")))
+}
+
+func TestStorage_enqueueWrite(t *testing.T) {
+	s, cleanup := newQueueStorage(t)
+	defer cleanup()
+
+	s.queueTestWrite(t, "a", "first")
+	s.queueTestWrite(t, "b", "other")
+	s.queueTestWrite(t, "a", "second")
+
+	// Reads see the latest queued write.
+	cert, found, err := s.queuedRecord("a")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("second"), cert.Raw)
+	assert.True(t, s.Exists("a"))
+	loaded, err := s.Load("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), loaded)
+
+	// Saved encrypted, owner only. The second write of a replaced the first.
+	names, err := filepath.Glob(filepath.Join(s.WriteQueueDir, "*.json"))
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+	info, err := os.Stat(names[0])
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	b, err := ioutil.ReadFile(names[0])
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "other")
+
+	// Reloaded in order.
+	q, err := openWriteQueue(s.WriteQueueDir)
+	assert.NoError(t, err)
+	var keys []string
+	for _, w := range q.writes {
+		keys = append(keys, w.Key)
+	}
+	assert.Equal(t, []string{"b", "a"}, keys)
+	assert.Equal(t, int64(3), q.nextSeq)
+
+	// Deleting a key drops its writes.
+	s.queue.discard("a")
+	_, found, _ = s.queuedRecord("a")
+	assert.False(t, found)
+	names, _ = filepath.Glob(filepath.Join(s.WriteQueueDir, "*.json"))
+	assert.Len(t, names, 1)
+}
+
+func TestStorage_sawVersion(t *testing.T) {
+	s, cleanup := newQueueStorage(t)
+	defer cleanup()
+
+	// Queued writes replace the version last seen.
+	seen := UTCNow()
+	s.sawVersion("a", seen)
+	s.queueTestWrite(t, "a", "value")
+	assert.True(t, s.queue.latest("a").UpdateTime.Equal(seen))
+
+	// Unknown once deleted.
+	s.sawVersion("a", time.Time{})
+	s.queueTestWrite(t, "a", "value")
+	assert.True(t, s.queue.latest("a").UpdateTime.IsZero())
+
+	// Not tracked without a write queue.
+	other := New()
+	other.sawVersion("a", seen)
+	assert.True(t, other.knownVersion("a").IsZero())
+}
+
+func TestStorage_acquireWriteQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write-queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Configs sharing a directory share its queue, replayed by the newest.
+	old, next := New(), New()
+	old.WriteQueueDir, next.WriteQueueDir = dir, dir
+	assert.NoError(t, old.acquireWriteQueue())
+	assert.NoError(t, next.acquireWriteQueue())
+	assert.Same(t, old.queue, next.queue)
+
+	q := next.queue
+	assert.NoError(t, old.releaseWriteQueue())
+	assert.Same(t, next, q.storage)
+	assert.NoError(t, next.releaseWriteQueue())
+	assert.Nil(t, q.storage)
+	<-q.done
+}
+
+func TestIsUnavailable(t *testing.T) {
+	assert.True(t, isUnavailable(status.Error(codes.Unavailable, "down")))
+	assert.True(t, isUnavailable(status.Error(codes.DeadlineExceeded, "slow")))
+	assert.False(t, isUnavailable(status.Error(codes.PermissionDenied, "no")))
+	assert.False(t, isUnavailable(status.Error(codes.Aborted, "contention")))
+	assert.False(t, isUnavailable(ErrStaleFence))
+}